@@ -19,7 +19,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
-	"syscall"
+	"time"
 
 	"github.com/upfluence/etcdenv/etcdenv"
 	"github.com/upfluence/goutils/log"
@@ -27,17 +27,96 @@ import (
 
 const currentVersion = "0.4.1"
 
+const defaultServer = "http://127.0.0.1:4001"
+
+// serversFlag collects the etcd members from repeated or comma-separated
+// flags, the default member being dropped as soon as one is given.
+type serversFlag struct {
+	servers []string
+	isSet   bool
+}
+
+func (f *serversFlag) String() string {
+	return strings.Join(f.servers, ",")
+}
+
+func (f *serversFlag) Set(value string) error {
+	if !f.isSet {
+		f.servers = nil
+		f.isSet = true
+	}
+
+	for _, server := range strings.Split(value, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			f.servers = append(f.servers, server)
+		}
+	}
+
+	return nil
+}
+
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	*f = append(*f, value)
+
+	return nil
+}
+
 var (
 	flagset = flag.NewFlagSet("etcdenv", flag.ExitOnError)
 	flags   = struct {
 		Version           bool
 		ShutdownBehaviour string
-		Server            string
+		SuccessStatuses   string
+		PreventStatuses   string
+		Servers           serversFlag
 		Namespace         string
 		WatchedKeys       string
 		UserName          string
 		Password          string
-	}{}
+		EtcdAPI           string
+		KeySeparator      string
+		KeyCase           string
+		CertFile          string
+		KeyFile           string
+		CACertFile        string
+		InsecureTLS       bool
+		SyncInterval      time.Duration
+		Debounce          time.Duration
+		DebounceMaxWait   time.Duration
+		RollbackWindow    time.Duration
+		ActionsFile       string
+		CacheDir          string
+		StartupPolicy     string
+		StartupTimeout    time.Duration
+		Backoff           etcdenv.BackoffConfig
+		Restart           etcdenv.RestartConfig
+		Readiness         etcdenv.Probe
+		Liveness          etcdenv.Probe
+		StopSignal        string
+		StopTimeout       time.Duration
+		NewSession        bool
+		Init              bool
+		Overlap           bool
+		Listen            listFlag
+		ReadyDelay        time.Duration
+		Exec              bool
+		ForwardSignals    string
+		ReloadSignals     string
+		ShutdownSignals   string
+	}{
+		Servers:   serversFlag{servers: []string{defaultServer}},
+		Backoff:   etcdenv.DefaultBackoffConfig(),
+		Restart:   etcdenv.DefaultRestartConfig(),
+		Readiness: etcdenv.DefaultProbe(),
+		Liveness:  etcdenv.DefaultProbe(),
+	}
 )
 
 func usage() {
@@ -57,11 +136,20 @@ func init() {
 	flagset.BoolVar(&flags.Version, "version", false, "Print the version and exit")
 	flagset.BoolVar(&flags.Version, "v", false, "Print the version and exit")
 
-	flagset.StringVar(&flags.ShutdownBehaviour, "b", "exit", "Behaviour when the process stop [exit|keepalive|restart]")
-	flagset.StringVar(&flags.ShutdownBehaviour, "shutdown-behaviour", "exit", "Behaviour when the process stop [exit|keepalive|restart]")
+	flagset.StringVar(&flags.ShutdownBehaviour, "b", "exit", "Behaviour when the process stop [always|on-success|on-failure|on-abnormal|never|keepalive], exit and restart being aliases of never and always")
+	flagset.StringVar(&flags.ShutdownBehaviour, "shutdown-behaviour", "exit", "Behaviour when the process stop [always|on-success|on-failure|on-abnormal|never|keepalive], exit and restart being aliases of never and always")
+	flagset.StringVar(&flags.SuccessStatuses, "success-exit-status", "", "exit statuses considered as a success in addition to 0, comma-separated")
+	flagset.StringVar(&flags.PreventStatuses, "restart-prevent-exit-status", "", "exit statuses never restarting the process, comma-separated")
+
+	flagset.Var(&flags.Servers, "server", "Location of the etcd server, repeatable or comma-separated")
+	flagset.Var(&flags.Servers, "s", "Location of the etcd server, repeatable or comma-separated")
 
-	flagset.StringVar(&flags.Server, "server", "http://127.0.0.1:4001", "Location of the etcd server")
-	flagset.StringVar(&flags.Server, "s", "http://127.0.0.1:4001", "Location of the etcd server")
+	flagset.DurationVar(&flags.SyncInterval, "sync-interval", etcdenv.DefaultSyncInterval, "interval between two etcd cluster membership syncs, 0 to disable")
+
+	flagset.DurationVar(&flags.Debounce, "debounce", 0, "quiet period merging the etcd changes into a single restart, 0 to restart on every change")
+	flagset.DurationVar(&flags.DebounceMaxWait, "debounce-max-wait", etcdenv.DefaultDebounceMaxWait, "maximum time a restart is delayed by the debounce")
+
+	flagset.DurationVar(&flags.RollbackWindow, "rollback-window", 0, "time a process started with a new environment must run healthily, the last known good environment being restored otherwise, 0 to disable")
 
 	flagset.StringVar(&flags.Namespace, "namespace", "/environments/production", "etcd directory where the environment variables are fetched")
 	flagset.StringVar(&flags.Namespace, "n", "/environments/production", "etcd directory where the environment variables are fetched")
@@ -69,16 +157,136 @@ func init() {
 	flagset.StringVar(&flags.WatchedKeys, "watched", "", "environment variables to watch, comma-separated")
 	flagset.StringVar(&flags.WatchedKeys, "w", "", "environment variables to watch, comma-separated")
 
+	flagset.StringVar(&flags.ActionsFile, "actions", "", "file of the actions reacting to the changes of the variables")
+
 	flagset.StringVar(&flags.UserName, "user", "", "user to authenticate to etcd server")
 	flagset.StringVar(&flags.UserName, "u", "", "user to authenticate to etcd server")
 
 	flagset.StringVar(&flags.Password, "password", "", "password to authenticate to etcd server")
 	flagset.StringVar(&flags.Password, "p", "", "password to authenticate to etcd server")
+
+	flagset.StringVar(&flags.CertFile, "cert", "", "TLS client certificate used to authenticate to etcd server")
+	flagset.StringVar(&flags.KeyFile, "key", "", "TLS client key used to authenticate to etcd server")
+	flagset.StringVar(&flags.CACertFile, "cacert", "", "CA certificate used to verify etcd server")
+	flagset.BoolVar(&flags.InsecureTLS, "insecure-skip-verify", false, "do not verify etcd server certificate, for development only")
+
+	flagset.StringVar(&flags.EtcdAPI, "etcd-api", etcdenv.EtcdAPIv2, "etcd API version used to read the namespaces [v2|v3]")
+
+	flagset.StringVar(&flags.StartupPolicy, "startup-policy", string(etcdenv.StartupDegraded), "Behaviour when a namespace can't be read at startup [strict|degraded|wait]")
+	flagset.DurationVar(&flags.StartupTimeout, "startup-timeout", etcdenv.DefaultStartupTimeout, "maximum time to wait for the namespaces with the wait startup policy, 0 to wait forever")
+
+	flagset.StringVar(&flags.StopSignal, "stop-signal", "SIGTERM", "signal sent to the process to stop it")
+	flagset.DurationVar(&flags.StopTimeout, "stop-timeout", etcdenv.DefaultStopTimeout, "time given to the process to stop before killing it")
+
+	flagset.BoolVar(&flags.NewSession, "new-session", false, "start the process in its own session instead of its own process group")
+	flagset.StringVar(&flags.Readiness.Target, "readiness-probe", "", "probe telling when the process is ready, http://host:port/path, tcp://host:port or exec:command")
+	flagset.DurationVar(&flags.Readiness.Interval, "readiness-interval", flags.Readiness.Interval, "interval between two checks of the readiness probe")
+	flagset.DurationVar(&flags.Readiness.Timeout, "readiness-timeout", flags.Readiness.Timeout, "timeout of a check of the readiness probe")
+	flagset.IntVar(&flags.Readiness.FailureThreshold, "readiness-failure-threshold", flags.Readiness.FailureThreshold, "number of failed checks in a row after which the process is stopped as never ready")
+
+	flagset.StringVar(&flags.Liveness.Target, "liveness-probe", "", "probe checking the ready process, http://host:port/path, tcp://host:port or exec:command")
+	flagset.DurationVar(&flags.Liveness.Interval, "liveness-interval", flags.Liveness.Interval, "interval between two checks of the liveness probe")
+	flagset.DurationVar(&flags.Liveness.Timeout, "liveness-timeout", flags.Liveness.Timeout, "timeout of a check of the liveness probe")
+	flagset.IntVar(&flags.Liveness.FailureThreshold, "liveness-failure-threshold", flags.Liveness.FailureThreshold, "number of failed checks in a row after which the process is stopped and handled as crashed")
+
+	flagset.Var(&flags.Listen, "listen", "address bound by etcdenv and handed over to the process, tcp://host:port or unix:///path, repeatable")
+
+	flagset.BoolVar(&flags.Overlap, "overlap", false, "start the new process before stopping the old one on restart")
+	flagset.DurationVar(&flags.ReadyDelay, "ready-delay", 0, "time after which a started process is considered ready, the old one being stopped then with overlap")
+
+	flagset.BoolVar(&flags.Exec, "exec", false, "fetch the environment once and replace etcdenv with the command, nothing is watched")
+	flagset.BoolVar(&flags.Init, "init", false, "reap the orphaned processes like an init, always enabled when running as PID 1")
+
+	flagset.StringVar(&flags.ForwardSignals, "forward-signals", "SIGHUP,SIGUSR1,SIGUSR2,SIGQUIT,SIGWINCH", "signals forwarded to the process, comma-separated")
+	flagset.StringVar(&flags.ReloadSignals, "reload-signals", "", "signals fetching the environment again and restarting the process, comma-separated")
+	flagset.StringVar(&flags.ShutdownSignals, "shutdown-signals", "SIGINT,SIGTERM", "signals stopping the process and etcdenv, comma-separated")
+
+	flagset.DurationVar(&flags.Backoff.InitialInterval, "retry-initial-interval", flags.Backoff.InitialInterval, "interval before the first retry of a failing etcd request")
+	flagset.Float64Var(&flags.Backoff.Multiplier, "retry-multiplier", flags.Backoff.Multiplier, "factor applied to the retry interval after each failure")
+	flagset.DurationVar(&flags.Backoff.MaxInterval, "retry-max-interval", flags.Backoff.MaxInterval, "maximum interval between two retries")
+	flagset.DurationVar(&flags.Backoff.MaxElapsedTime, "retry-max-elapsed-time", flags.Backoff.MaxElapsedTime, "time after which the retries stop, 0 to never stop")
+	flagset.IntVar(&flags.Backoff.MaxRetries, "retry-max", flags.Backoff.MaxRetries, "maximum number of retries, 0 for no limit on the watches")
+	flagset.BoolVar(&flags.Backoff.StopWatches, "retry-stop-watches", false, "stop watching a namespace once the retry limits are reached")
+
+	flagset.DurationVar(&flags.Restart.InitialInterval, "restart-initial-interval", flags.Restart.InitialInterval, "delay before restarting a crashing process, growing while it keeps crashing")
+	flagset.DurationVar(&flags.Restart.MaxInterval, "restart-max-interval", flags.Restart.MaxInterval, "maximum delay before restarting a crashing process")
+	flagset.DurationVar(&flags.Restart.HealthyUptime, "restart-healthy-uptime", flags.Restart.HealthyUptime, "uptime after which the process is not considered as crashing anymore")
+	flagset.IntVar(&flags.Restart.MaxRestarts, "restart-max", flags.Restart.MaxRestarts, "maximum number of restarts within the restart window, 0 for no limit")
+	flagset.DurationVar(&flags.Restart.Window, "restart-window", flags.Restart.Window, "window in which the restarts are counted")
+
+	flagset.StringVar(&flags.CacheDir, "cache-dir", "", "directory where the last fetched environment is cached, used when etcd is unreachable")
+
+	flagset.StringVar(&flags.KeySeparator, "key-separator", etcdenv.DefaultKeySeparator, "separator joining the nested directories of a key into a variable name")
+	flagset.StringVar(&flags.KeyCase, "key-case", string(etcdenv.KeyCasePreserve), "case of the variable names [preserve|upper|lower]")
+}
+
+type signalAction int
+
+const (
+	forwardAction signalAction = iota
+	reloadAction
+	shutdownAction
+)
+
+// signalActions maps every handled signal to its action, a signal being
+// bound to a single action. The lists given on the command line take their
+// signals out of the default ones.
+func signalActions() (map[os.Signal]signalAction, error) {
+	var (
+		actions = make(map[os.Signal]signalAction)
+		set     = make(map[string]bool)
+	)
+
+	flagset.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	lists := []struct {
+		action signalAction
+		name   string
+		value  string
+	}{
+		{forwardAction, "forward-signals", flags.ForwardSignals},
+		{reloadAction, "reload-signals", flags.ReloadSignals},
+		{shutdownAction, "shutdown-signals", flags.ShutdownSignals},
+	}
+
+	// The explicit lists are bound first, the defaults only get the
+	// signals left
+	for _, explicit := range []bool{true, false} {
+		for _, list := range lists {
+			if set[list.name] != explicit {
+				continue
+			}
+
+			signals, err := etcdenv.ParseSignals(list.value)
+
+			if err != nil {
+				return nil, err
+			}
+
+			for _, sig := range signals {
+				if action, ok := actions[sig]; ok {
+					if !explicit {
+						continue
+					}
+
+					if action != list.action {
+						return nil, fmt.Errorf("Signal %s is bound to several actions", sig)
+					}
+				}
+
+				actions[sig] = list.action
+			}
+		}
+	}
+
+	return actions, nil
 }
 
 func main() {
 	var watchedKeysList []string
 
+	etcdenv.RunListenShim()
+
 	flagset.Parse(os.Args[1:])
 	flagset.Usage = usage
 
@@ -92,23 +300,106 @@ func main() {
 		os.Exit(0)
 	}
 
-	signalChan := make(chan os.Signal)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-
 	if flags.WatchedKeys == "" {
 		watchedKeysList = []string{}
 	} else {
 		watchedKeysList = strings.Split(flags.WatchedKeys, ",")
 	}
 
+	keyCase, err := etcdenv.ParseKeyCase(flags.KeyCase)
+
+	if err != nil {
+		log.Fatalf(err.Error())
+		os.Exit(1)
+	}
+
+	restartMode, err := etcdenv.ParseRestartMode(flags.ShutdownBehaviour)
+
+	if err != nil {
+		log.Fatalf(err.Error())
+		os.Exit(1)
+	}
+
+	successStatuses, err := etcdenv.ParseExitStatuses(flags.SuccessStatuses)
+
+	if err != nil {
+		log.Fatalf(err.Error())
+		os.Exit(1)
+	}
+
+	preventStatuses, err := etcdenv.ParseExitStatuses(flags.PreventStatuses)
+
+	if err != nil {
+		log.Fatalf(err.Error())
+		os.Exit(1)
+	}
+
+	startupPolicy, err := etcdenv.ParseStartupPolicy(flags.StartupPolicy)
+
+	if err != nil {
+		log.Fatalf(err.Error())
+		os.Exit(1)
+	}
+
+	if err := flags.Backoff.Validate(); err != nil {
+		log.Fatalf(err.Error())
+		os.Exit(1)
+	}
+
+	if err := flags.Restart.Validate(); err != nil {
+		log.Fatalf(err.Error())
+		os.Exit(1)
+	}
+
+	stopSignal, err := etcdenv.ParseSignal(flags.StopSignal)
+
+	if err != nil {
+		log.Fatalf(err.Error())
+		os.Exit(1)
+	}
+
+	actions, err := signalActions()
+
+	if err != nil {
+		log.Fatalf(err.Error())
+		os.Exit(1)
+	}
+
+	var tlsConfig *etcdenv.TLSConfig
+
+	if flags.CertFile != "" || flags.KeyFile != "" || flags.CACertFile != "" ||
+		flags.InsecureTLS {
+		tlsConfig = &etcdenv.TLSConfig{
+			CertFile:           flags.CertFile,
+			KeyFile:            flags.KeyFile,
+			CACertFile:         flags.CACertFile,
+			InsecureSkipVerify: flags.InsecureTLS,
+		}
+	}
+
+	source, err := etcdenv.NewEtcdSource(
+		flags.EtcdAPI,
+		flags.Servers.servers,
+		flags.UserName,
+		flags.Password,
+		tlsConfig,
+	)
+
+	if err != nil {
+		log.Fatalf(err.Error())
+		os.Exit(1)
+	}
+
 	ctx, err := etcdenv.NewContext(
 		strings.Split(flags.Namespace, ","),
-		[]string{flags.Server},
+		source,
 		flagset.Args(),
-		flags.ShutdownBehaviour,
+		etcdenv.RestartPolicy{
+			Mode:                restartMode,
+			SuccessExitStatuses: successStatuses,
+			PreventExitStatuses: preventStatuses,
+		},
 		watchedKeysList,
-		flags.UserName,
-		flags.Password,
 	)
 
 	if err != nil {
@@ -116,13 +407,120 @@ func main() {
 		os.Exit(1)
 	}
 
-	go ctx.Run()
+	ctx.KeySeparator = flags.KeySeparator
+	ctx.KeyCase = keyCase
+	ctx.SyncInterval = flags.SyncInterval
+	ctx.Debounce = flags.Debounce
+	ctx.DebounceMaxWait = flags.DebounceMaxWait
+	ctx.RollbackWindow = flags.RollbackWindow
+
+	if flags.ActionsFile != "" {
+		if ctx.KeyActions, err = etcdenv.LoadKeyActions(flags.ActionsFile); err != nil {
+			log.Fatalf("Can't load the actions of %s: %s", flags.ActionsFile, err.Error())
+			os.Exit(1)
+		}
+	}
+	ctx.StartupPolicy = startupPolicy
+	ctx.StartupTimeout = flags.StartupTimeout
+	ctx.Backoff = flags.Backoff
+	ctx.Restart = flags.Restart
+	ctx.Runner.StopSignal = stopSignal
+	ctx.Runner.StopTimeout = flags.StopTimeout
+	ctx.Runner.NewSession = flags.NewSession
+	ctx.Runner.Overlap = flags.Overlap
+	ctx.Runner.ReadyDelay = flags.ReadyDelay
+
+	if flags.Readiness.Target != "" {
+		if err := flags.Readiness.Validate(); err != nil {
+			log.Fatalf(err.Error())
+			os.Exit(1)
+		}
+
+		ctx.Runner.ReadinessProbe = &flags.Readiness
+	}
+
+	if flags.Liveness.Target != "" {
+		if err := flags.Liveness.Validate(); err != nil {
+			log.Fatalf(err.Error())
+			os.Exit(1)
+		}
+
+		ctx.Runner.LivenessProbe = &flags.Liveness
+	}
+
+	for _, address := range flags.Listen {
+		listener, err := etcdenv.Listen(address)
+
+		if err != nil {
+			log.Fatalf("Can't listen on %s: %s", address, err.Error())
+			os.Exit(1)
+		}
+
+		ctx.Runner.Listeners = append(ctx.Runner.Listeners, listener)
+	}
+
+	if flags.CacheDir != "" {
+		ctx.Cache = etcdenv.NewCache(flags.CacheDir, ctx.Namespaces)
+	}
+
+	if flags.Exec {
+		exit(source, ctx.Exec())
+	}
+
+	signalChan := make(chan os.Signal, 16)
+
+	for sig := range actions {
+		signal.Notify(signalChan, sig)
+	}
+
+	if flags.Init || os.Getpid() == 1 {
+		go etcdenv.ReapOrphans(ctx.Runner)
+	}
+
+	done := make(chan int, 1)
+
+	go func() {
+		done <- ctx.Run()
+	}()
+
+	for {
+		select {
+		case sig := <-signalChan:
+			switch actions[sig] {
+			case shutdownAction:
+				log.Noticef("Received signal %s", sig)
 
-	select {
-	case sig := <-signalChan:
-		log.Noticef("Received signal %s", sig)
-		ctx.ExitChan <- true
-	case <-ctx.ExitChan:
-		log.Infof("Catching ExitChan, doing nothin'")
+				select {
+				case ctx.ExitChan <- true:
+					exit(source, <-done)
+				case status := <-done:
+					exit(source, status)
+				}
+			case reloadAction:
+				log.Noticef("Received signal %s, reloading", sig)
+
+				select {
+				case ctx.ReloadChan <- true:
+				case status := <-done:
+					exit(source, status)
+				}
+			case forwardAction:
+				log.Infof("Forwarding signal %s", sig)
+
+				if err := ctx.Runner.Signal(sig); err != nil {
+					log.Warningf("Can't forward signal %s: %s", sig, err.Error())
+				}
+			}
+		case status := <-done:
+			exit(source, status)
+		}
 	}
 }
+
+func exit(source etcdenv.Source, status int) {
+	log.Noticef("Exiting with status %d", status)
+	source.Close()
+	os.Stdout.Sync()
+	os.Stderr.Sync()
+	os.Exit(status)
+}
@@ -0,0 +1,221 @@
+package etcdenv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/upfluence/goutils/log"
+)
+
+// ActionsKey is the key of a namespace holding its key actions, it is not
+// exported as a variable. It can't start with an underscore, etcd v2 hides
+// such keys from the listings and the watches of the namespace.
+const ActionsKey = "etcdenv.actions"
+
+// ActionType is the reaction to the change of a variable.
+type ActionType string
+
+const (
+	// ActionRestart restarts the process with the new environment.
+	ActionRestart ActionType = "restart"
+	// ActionSignal sends a signal to the process so it reloads its
+	// configuration by itself.
+	ActionSignal ActionType = "signal"
+	// ActionHook runs a command with the old and the new values.
+	ActionHook ActionType = "hook"
+	// ActionNextRestart applies the change on the next restart only.
+	ActionNextRestart ActionType = "next-restart"
+	// ActionIgnore ignores the change.
+	ActionIgnore ActionType = "ignore"
+)
+
+// KeyAction is the reaction to the change of the variables matching the
+// glob pattern.
+type KeyAction struct {
+	Pattern string
+	Type    ActionType
+	Signal  syscall.Signal
+	Command string
+}
+
+// ParseKeyActions parses one action per line, empty lines and lines
+// starting with # being skipped:
+//
+//	DATABASE_*  restart
+//	LOG_LEVEL   signal SIGHUP
+//	FEATURE_*   hook /usr/local/bin/notify
+//	CACHE_TTL   next-restart
+//	BUILD_*     ignore
+func ParseKeyActions(r io.Reader) ([]KeyAction, error) {
+	var result []KeyAction
+
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		action, err := parseKeyAction(fields)
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+
+		result = append(result, action)
+	}
+
+	return result, scanner.Err()
+}
+
+func parseKeyAction(fields []string) (KeyAction, error) {
+	if len(fields) < 2 {
+		return KeyAction{}, fmt.Errorf("A pattern and an action are expected")
+	}
+
+	action := KeyAction{Pattern: fields[0], Type: ActionType(fields[1])}
+
+	if _, err := path.Match(action.Pattern, ""); err != nil {
+		return KeyAction{}, fmt.Errorf("Invalid pattern %s", action.Pattern)
+	}
+
+	switch action.Type {
+	case ActionRestart, ActionNextRestart, ActionIgnore:
+		if len(fields) > 2 {
+			return KeyAction{}, fmt.Errorf("The %s action takes no argument", action.Type)
+		}
+	case ActionSignal:
+		if len(fields) != 3 {
+			return KeyAction{}, fmt.Errorf("The signal action takes a signal")
+		}
+
+		sig, err := ParseSignal(fields[2])
+
+		if err != nil {
+			return KeyAction{}, err
+		}
+
+		action.Signal = sig
+	case ActionHook:
+		if len(fields) < 3 {
+			return KeyAction{}, fmt.Errorf("The hook action takes a command")
+		}
+
+		action.Command = strings.Join(fields[2:], " ")
+	default:
+		return KeyAction{}, fmt.Errorf(
+			"Choose a correct action : %s | %s | %s | %s | %s",
+			ActionRestart,
+			ActionSignal,
+			ActionHook,
+			ActionNextRestart,
+			ActionIgnore,
+		)
+	}
+
+	return action, nil
+}
+
+// LoadKeyActions reads the actions of the file.
+func LoadKeyActions(filename string) ([]KeyAction, error) {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ParseKeyActions(f)
+}
+
+// actionFor returns the first action matching the variable, the actions
+// of the namespaces coming before the ones of the file. The variable
+// restarts the process when no action matches and it is watched.
+func (ctx *Context) actionFor(key string) KeyAction {
+	var actions []KeyAction
+
+	for _, namespace := range ctx.Namespaces {
+		actions = append(actions, ctx.namespaceActions[namespace]...)
+	}
+
+	for _, action := range append(actions, ctx.KeyActions...) {
+		if ok, _ := path.Match(action.Pattern, key); ok {
+			return action
+		}
+	}
+
+	if len(ctx.WatchedKeys) == 0 || containsString(ctx.WatchedKeys, key) {
+		return KeyAction{Pattern: key, Type: ActionRestart}
+	}
+
+	return KeyAction{Pattern: key, Type: ActionIgnore}
+}
+
+// actionsNamespace returns the namespace whose actions are held by the
+// key, if any.
+func (ctx *Context) actionsNamespace(key string) (string, bool) {
+	for _, namespace := range ctx.Namespaces {
+		if key == namespacePrefix(namespace)+ActionsKey {
+			return namespace, true
+		}
+	}
+
+	return "", false
+}
+
+// setNamespaceActions replaces the actions of the namespace by the ones
+// held by its actions key, the previous ones being kept when invalid.
+func (ctx *Context) setNamespaceActions(namespace, value string) {
+	actions, err := ParseKeyActions(strings.NewReader(value))
+
+	if err != nil {
+		log.Errorf("Invalid actions in %s: %s", namespace, err.Error())
+		return
+	}
+
+	ctx.namespaceActions[namespace] = actions
+}
+
+// react applies the action of a variable which doesn't restart the
+// process, the environment of the process being left as it is.
+func (ctx *Context) react(action KeyAction, key, oldValue, newValue string) {
+	switch action.Type {
+	case ActionSignal:
+		log.Noticef("%s changed, sending %s to the child process", key, action.Signal)
+
+		if err := ctx.Runner.Signal(action.Signal); err != nil {
+			log.Errorf("Can't signal the child process: %s", err.Error())
+		}
+	case ActionHook:
+		log.Noticef("%s changed, running %s", key, action.Command)
+
+		cmd := exec.Command("/bin/sh", "-c", action.Command)
+		cmd.Env = append(
+			os.Environ(),
+			"ETCDENV_KEY="+key,
+			"ETCDENV_OLD_VALUE="+oldValue,
+			"ETCDENV_NEW_VALUE="+newValue,
+		)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		go func() {
+			if err := ctx.Runner.runCommand(cmd); err != nil {
+				log.Errorf("The hook of %s failed: %s", key, err.Error())
+			}
+		}()
+	case ActionNextRestart:
+		log.Noticef("%s changed, applied on the next restart", key)
+	default:
+		log.Infof("%s changed, ignored", key)
+	}
+}
@@ -0,0 +1,119 @@
+package etcdenv
+
+import (
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseKeyActions(t *testing.T) {
+	actions, err := ParseKeyActions(strings.NewReader(`
+# pattern   action
+DATABASE_*  restart
+LOG_LEVEL   signal SIGHUP
+
+FEATURE_*   hook /usr/local/bin/notify --all
+CACHE_TTL   next-restart
+BUILD_*     ignore
+`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []KeyAction{
+		{Pattern: "DATABASE_*", Type: ActionRestart},
+		{Pattern: "LOG_LEVEL", Type: ActionSignal, Signal: syscall.SIGHUP},
+		{Pattern: "FEATURE_*", Type: ActionHook, Command: "/usr/local/bin/notify --all"},
+		{Pattern: "CACHE_TTL", Type: ActionNextRestart},
+		{Pattern: "BUILD_*", Type: ActionIgnore},
+	}
+
+	if !reflect.DeepEqual(actions, expected) {
+		t.Errorf("Expected the actions %+v, got %+v", expected, actions)
+	}
+}
+
+func TestParseKeyActionsErrors(t *testing.T) {
+	for _, tt := range []struct {
+		input, err string
+	}{
+		{"FOO", "line 1: A pattern and an action are expected"},
+		{"\nFOO reboot", "line 2: Choose a correct action"},
+		{"[FOO restart", "line 1: Invalid pattern [FOO"},
+		{"FOO restart now", "line 1: The restart action takes no argument"},
+		{"FOO signal", "line 1: The signal action takes a signal"},
+		{"FOO signal SIGFOO", "line 1: "},
+		{"FOO hook", "line 1: The hook action takes a command"},
+	} {
+		_, err := ParseKeyActions(strings.NewReader(tt.input))
+
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("ParseKeyActions(%q) = %v, expected the error %q", tt.input, err, tt.err)
+		}
+	}
+}
+
+func TestActionFor(t *testing.T) {
+	ctx, err := NewContext(
+		[]string{"/app", "/shared"},
+		NewMemorySource(),
+		[]string{"true"},
+		RestartPolicy{Mode: RestartAlways},
+		[]string{"WATCHED"},
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.KeyActions = []KeyAction{
+		{Pattern: "LOG_*", Type: ActionSignal, Signal: syscall.SIGHUP},
+		{Pattern: "LOG_LEVEL", Type: ActionRestart},
+		{Pattern: "CACHE_*", Type: ActionNextRestart},
+	}
+	ctx.setNamespaceActions("/shared", "CACHE_TTL hook notify\nLOG_* ignore")
+	ctx.setNamespaceActions("/app", "CACHE_* restart")
+
+	// An invalid value keeps the previous actions
+	ctx.setNamespaceActions("/app", "CACHE_* reboot")
+
+	for key, expected := range map[string]ActionType{
+		// The actions of the namespaces come before the ones of the file
+		"LOG_LEVEL": ActionIgnore,
+		// The namespaces come in their order
+		"CACHE_TTL":  ActionRestart,
+		"CACHE_SIZE": ActionRestart,
+		// Without action, only the watched variables restart the process
+		"WATCHED": ActionRestart,
+		"OTHER":   ActionIgnore,
+	} {
+		if action := ctx.actionFor(key); action.Type != expected {
+			t.Errorf("Expected the action %s for %s, got %s", expected, key, action.Type)
+		}
+	}
+
+	// The first action of the file matching wins
+	ctx.Namespaces = []string{"/other"}
+
+	if action := ctx.actionFor("LOG_LEVEL"); action.Type != ActionSignal || action.Signal != syscall.SIGHUP {
+		t.Errorf("Expected the first action of the file for LOG_LEVEL, got %+v", action)
+	}
+}
+
+func TestActionsNamespace(t *testing.T) {
+	ctx, err := NewContext([]string{"/app/"}, NewMemorySource(), []string{"true"}, RestartPolicy{Mode: RestartAlways}, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if namespace, ok := ctx.actionsNamespace("/app/" + ActionsKey); !ok || namespace != "/app/" {
+		t.Errorf("Expected the actions key of /app/, got %q, %v", namespace, ok)
+	}
+
+	if _, ok := ctx.actionsNamespace("/app/sub/" + ActionsKey); ok {
+		t.Error("Expected a nested key not to hold the actions")
+	}
+}
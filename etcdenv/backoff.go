@@ -0,0 +1,95 @@
+package etcdenv
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+const DefaultMaxRetries = 3
+
+// BackoffConfig drives the retries of both the fetching of the namespaces
+// and the watches. MaxElapsedTime and MaxRetries only stop the watches
+// when StopWatches is set, they retry forever otherwise.
+type BackoffConfig struct {
+	InitialInterval time.Duration
+	Multiplier      float64
+	MaxInterval     time.Duration
+	MaxElapsedTime  time.Duration
+	MaxRetries      int
+	StopWatches     bool
+}
+
+func DefaultBackoffConfig() BackoffConfig {
+	return BackoffConfig{
+		InitialInterval: backoff.DefaultInitialInterval,
+		Multiplier:      backoff.DefaultMultiplier,
+		MaxInterval:     backoff.DefaultMaxInterval,
+		MaxElapsedTime:  backoff.DefaultMaxElapsedTime,
+		MaxRetries:      DefaultMaxRetries,
+	}
+}
+
+func (c BackoffConfig) Validate() error {
+	if c.InitialInterval <= 0 || c.MaxInterval < c.InitialInterval {
+		return errors.New("The retry intervals must be positive, the maximum one being greater than the initial one")
+	}
+
+	if c.Multiplier < 1 {
+		return errors.New("The retry multiplier must be greater or equal to 1")
+	}
+
+	if c.MaxElapsedTime < 0 || c.MaxRetries < 0 {
+		return errors.New("The retry limits must be positive")
+	}
+
+	return nil
+}
+
+func (c BackoffConfig) newBackOff() *backoff.ExponentialBackOff {
+	b := backoff.NewExponentialBackOff()
+
+	b.InitialInterval = c.InitialInterval
+	b.Multiplier = c.Multiplier
+	b.MaxInterval = c.MaxInterval
+	b.MaxElapsedTime = c.MaxElapsedTime
+	b.Reset()
+
+	return b
+}
+
+// watchBackOff returns the backoff of the watches, which gives up only
+// when the configuration asks for it.
+func (c BackoffConfig) watchBackOff() *watchBackOff {
+	return &watchBackOff{config: c, b: c.newBackOff()}
+}
+
+type watchBackOff struct {
+	config  BackoffConfig
+	b       *backoff.ExponentialBackOff
+	retries int
+}
+
+func (w *watchBackOff) Reset() {
+	w.retries = 0
+	w.b.Reset()
+}
+
+func (w *watchBackOff) NextBackOff() time.Duration {
+	t := w.b.NextBackOff()
+
+	if !w.config.StopWatches {
+		if t == backoff.Stop {
+			return w.config.MaxInterval
+		}
+
+		return t
+	}
+
+	if w.retries++; w.config.MaxRetries > 0 && w.retries > w.config.MaxRetries {
+		return backoff.Stop
+	}
+
+	return t
+}
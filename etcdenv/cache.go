@@ -0,0 +1,89 @@
+package etcdenv
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Cache keeps on disk the last environment successfully fetched for a set
+// of namespaces, so the command can start while etcd is unreachable.
+type Cache struct {
+	Path string
+}
+
+type CacheEntry struct {
+	Namespaces []string          `json:"namespaces"`
+	Indexes    map[string]uint64 `json:"indexes"`
+	Env        map[string]string `json:"env"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// NewCache returns the cache of the namespace set in the given directory,
+// the namespaces order being part of the set as it drives the precedence.
+func NewCache(dir string, namespaces []string) *Cache {
+	sum := sha1.Sum([]byte(strings.Join(namespaces, ",")))
+
+	return &Cache{
+		Path: filepath.Join(dir, "etcdenv-"+hex.EncodeToString(sum[:])+".json"),
+	}
+}
+
+func (c *Cache) Load() (*CacheEntry, error) {
+	var entry CacheEntry
+
+	data, err := ioutil.ReadFile(c.Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// Save writes the entry to a temporary file renamed over the cache, so the
+// cache is never left half written.
+func (c *Cache) Save(entry *CacheEntry) error {
+	data, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0700); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(c.Path), filepath.Base(c.Path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), c.Path)
+}
@@ -0,0 +1,90 @@
+package etcdenv
+
+import (
+	"strings"
+	"sync"
+)
+
+// ClusterSource is implemented by the sources backed by several members,
+// the context keeps their member list up to date. Their watches report
+// the member they are connected to.
+type ClusterSource interface {
+	Source
+
+	// SyncCluster refreshes the member list from the cluster membership.
+	SyncCluster() error
+}
+
+// members is a list of cluster members sticking to the same member until
+// it fails.
+type members struct {
+	mu      sync.Mutex
+	urls    []string
+	current int
+}
+
+func newMembers(urls []string) *members {
+	return &members{urls: urls}
+}
+
+func (m *members) pick() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.urls) == 0 {
+		return ""
+	}
+
+	return m.urls[m.current]
+}
+
+// all returns every member, starting with the current one.
+func (m *members) all() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]string, 0, len(m.urls))
+
+	for i := range m.urls {
+		result = append(result, m.urls[(m.current+i)%len(m.urls)])
+	}
+
+	return result
+}
+
+// failure moves to the next member if the failing one is the current one.
+func (m *members) failure(url string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.urls) > 0 && m.urls[m.current] == url {
+		m.current = (m.current + 1) % len(m.urls)
+	}
+}
+
+// set replaces the member list, keeping the current member when it is
+// still part of the cluster.
+func (m *members) set(urls []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(urls) == 0 {
+		return
+	}
+
+	current := ""
+
+	if len(m.urls) > 0 {
+		current = m.urls[m.current]
+	}
+
+	m.urls = urls
+	m.current = 0
+
+	for i, url := range urls {
+		if strings.TrimSuffix(url, "/") == strings.TrimSuffix(current, "/") {
+			m.current = i
+			break
+		}
+	}
+}
@@ -1,118 +1,303 @@
 package etcdenv
 
 import (
-	"errors"
-	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/cenkalti/backoff"
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/upfluence/goutils/log"
 )
 
+const DefaultSyncInterval = 5 * time.Minute
+
 type Context struct {
-	Namespaces        []string
-	Runner            *Runner
-	ExitChan          chan bool
-	ShutdownBehaviour string
-	WatchedKeys       []string
-	CurrentEnv        map[string]string
-	maxRetry          int
-	etcdClient        *etcd.Client
-}
-
-func NewContext(namespaces []string, endpoints, command []string,
-	shutdownBehaviour string, watchedKeys []string, username string, password string) (*Context, error) {
-
-	if shutdownBehaviour != "keepalive" && shutdownBehaviour != "restart" &&
-		shutdownBehaviour != "exit" {
-		return nil,
-			errors.New(
-				"Choose a correct shutdown behaviour : keepalive | exit | restart",
-			)
-	}
+	Namespaces     []string
+	Runner         *Runner
+	ExitChan       chan bool
+	ReloadChan     chan bool
+	RestartPolicy  RestartPolicy
+	WatchedKeys    []string
+	CurrentEnv     map[string]string
+	KeySeparator   string
+	KeyCase        KeyCase
+	SyncInterval   time.Duration
+	Cache          *Cache
+	StartupPolicy  StartupPolicy
+	StartupTimeout time.Duration
+	Backoff        BackoffConfig
+	Restart        RestartConfig
+	Source         Source
+	// Debounce is the quiet period waited after a change before restarting
+	// the process, the changes happening in between are merged. The
+	// restart is delayed at most by DebounceMaxWait.
+	Debounce        time.Duration
+	DebounceMaxWait time.Duration
+
+	// RollbackWindow is the time a process started after a change of the
+	// environment must run healthily, the last known good environment is
+	// restored when it fails before. 0 disables the rollbacks.
+	RollbackWindow time.Duration
+	// KeyActions are the reactions to the changes of the variables, after
+	// the ones held by the ActionsKey of the namespaces.
+	KeyActions []KeyAction
+
+	// stopChan is closed on shutdown to stop the watches
+	stopChan chan bool
+
+	lastGoodEnv      map[string]string
+	blockedEnv       map[string]string
+	namespaceActions map[string][]KeyAction
+	// seenEnv are the last values of the variables which didn't restart
+	// the process
+	seenEnv map[string]string
+	// probation is the generation started with a new environment, not
+	// healthy yet
+	probation uint64
+	// envs are the environments of the generations not replaced yet
+	envs map[uint64]map[string]string
+}
+
+func NewContext(namespaces []string, source Source, command []string,
+	restartPolicy RestartPolicy, watchedKeys []string) (*Context, error) {
 
-        etcdClient := etcd.NewClient(endpoints)
+	if err := restartPolicy.Validate(); err != nil {
+		return nil, err
+	}
 
-        if username != "" && password != "" {
-                etcdClient.SetCredentials(username, password)
-        }
+	// The aliases are only accepted on input, the policy matches the
+	// canonical modes
+	restartPolicy.Mode, _ = ParseRestartMode(string(restartPolicy.Mode))
 
 	return &Context{
-		Namespaces:        namespaces,
-		Runner:            NewRunner(command),
-		etcdClient:        etcdClient,
-		ShutdownBehaviour: shutdownBehaviour,
-		ExitChan:          make(chan bool),
-		WatchedKeys:       watchedKeys,
-		CurrentEnv:        make(map[string]string),
-		maxRetry:          3,
+		Namespaces:       namespaces,
+		Runner:           NewRunner(command),
+		Source:           source,
+		RestartPolicy:    restartPolicy,
+		ExitChan:         make(chan bool),
+		ReloadChan:       make(chan bool),
+		WatchedKeys:      watchedKeys,
+		CurrentEnv:       make(map[string]string),
+		KeySeparator:     DefaultKeySeparator,
+		KeyCase:          KeyCasePreserve,
+		SyncInterval:     DefaultSyncInterval,
+		StartupPolicy:    StartupDegraded,
+		StartupTimeout:   DefaultStartupTimeout,
+		Backoff:          DefaultBackoffConfig(),
+		Restart:          DefaultRestartConfig(),
+		DebounceMaxWait:  DefaultDebounceMaxWait,
+		stopChan:         make(chan bool),
+		namespaceActions: make(map[string][]KeyAction),
+		seenEnv:          make(map[string]string),
+		envs:             make(map[uint64]map[string]string),
 	}, nil
 }
 
 func (ctx *Context) escapeNamespace(key string) string {
 	for _, namespace := range ctx.Namespaces {
-		if strings.HasPrefix(key, namespace) {
-			key = strings.TrimPrefix(key, namespace)
+		if prefix := namespacePrefix(namespace); strings.HasPrefix(key, prefix) {
+			key = strings.TrimPrefix(key, prefix)
 			break
 		}
 	}
 
-	return strings.TrimPrefix(key, "/")
+	return flattenKey(key, ctx.KeySeparator, ctx.KeyCase)
 }
 
-func (ctx *Context) fetchEtcdNamespaceVariables(namespace string, currentRetry int, b *backoff.ExponentialBackOff) map[string]string {
+func (ctx *Context) fetchEtcdNamespaceVariables(namespace string, currentRetry int, b *backoff.ExponentialBackOff) (map[string]string, uint64, error) {
 	result := make(map[string]string)
 
-	response, err := ctx.etcdClient.Get(namespace, false, false)
+	nodes, index, err := ctx.Source.Snapshot(namespace)
 
 	if err != nil {
 		log.Errorf("etcd fetching error: %s", err.Error())
 
-		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == etcd.ErrCodeEtcdNotReachable {
+		if isError(err, ErrEtcdNotReachable) {
 			log.Error("Can't join the etcd server, fallback to the env variables")
-		} else if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == ErrKeyNotFound {
+		} else if isError(err, ErrKeyNotFound) {
 			log.Error("The namespace does not exist, fallback to the env variables")
 		}
 
-		if currentRetry < ctx.maxRetry {
+		if currentRetry < ctx.Backoff.MaxRetries {
 			log.Info("retry fetching variables")
 			t := b.NextBackOff()
+
+			if t == backoff.Stop {
+				return result, 0, err
+			}
+
 			time.Sleep(t)
 			return ctx.fetchEtcdNamespaceVariables(namespace, currentRetry+1, b)
 		} else {
-			return result
+			return result, 0, err
 		}
 
 	}
 
-	for _, node := range response.Node.Nodes {
-		key := ctx.escapeNamespace(node.Key)
+	nodeKeys := make([]string, 0, len(nodes))
+
+	for nodeKey := range nodes {
+		nodeKeys = append(nodeKeys, nodeKey)
+	}
+
+	// Sorted so a flattened name clashing with another key always resolves
+	// to the same value
+	sort.Strings(nodeKeys)
+
+	delete(ctx.namespaceActions, namespace)
+
+	for _, nodeKey := range nodeKeys {
+		if nodeKey == namespacePrefix(namespace)+ActionsKey {
+			ctx.setNamespaceActions(namespace, nodes[nodeKey])
+			continue
+		}
+
+		key := ctx.escapeNamespace(nodeKey)
 		if _, ok := result[key]; !ok {
-			result[key] = node.Value
+			result[key] = nodes[nodeKey]
 		}
 	}
 
-	return result
+	return result, index, nil
 }
 
-func (ctx *Context) fetchEtcdVariables() map[string]string {
+// fetchNamespaces returns the variables of every namespace, the etcd index
+// each namespace has been read at and the error of the failing namespaces.
+func (ctx *Context) fetchNamespaces() (map[string]string, map[string]uint64, map[string]error) {
 	result := make(map[string]string)
+	indexes := make(map[string]uint64)
+	errs := make(map[string]error)
 
-	b := backoff.NewExponentialBackOff()
+	b := ctx.Backoff.newBackOff()
 
 	for _, namespace := range ctx.Namespaces {
 		b.Reset()
 
-		for key, value := range ctx.fetchEtcdNamespaceVariables(namespace, 0, b) {
+		variables, index, err := ctx.fetchEtcdNamespaceVariables(namespace, 0, b)
+		indexes[namespace] = index
+
+		if err != nil {
+			errs[namespace] = err
+		}
+
+		for key, value := range variables {
 			if _, ok := result[key]; !ok {
 				result[key] = value
 			}
 		}
 	}
 
-	return result
+	return result, indexes, errs
+}
+
+// fetchEtcdVariables returns the variables of every namespace and the etcd
+// index each namespace has been read at.
+func (ctx *Context) fetchEtcdVariables() (map[string]string, map[string]uint64) {
+	return ctx.withCache(ctx.fetchNamespaces())
+}
+
+// withCache returns the environment of the cache when etcd can't be
+// reached, if any, and caches the fetched environment otherwise.
+func (ctx *Context) withCache(result map[string]string, indexes map[string]uint64, errs map[string]error) (map[string]string, map[string]uint64) {
+	var unreachable bool
+
+	if ctx.Cache == nil {
+		return result, indexes
+	}
+
+	for _, err := range errs {
+		if isError(err, ErrEtcdNotReachable) {
+			unreachable = true
+		}
+	}
+
+	if unreachable {
+		entry, err := ctx.Cache.Load()
+
+		if err != nil {
+			log.Errorf("Can't load the cache %s: %s", ctx.Cache.Path, err.Error())
+			return result, indexes
+		}
+
+		log.Noticef(
+			"etcd not reachable, using the environment cached at %s",
+			entry.UpdatedAt.Format(time.RFC3339),
+		)
+
+		return entry.Env, entry.Indexes
+	}
+
+	if err := ctx.Cache.Save(
+		&CacheEntry{
+			Namespaces: ctx.Namespaces,
+			Indexes:    indexes,
+			Env:        result,
+			UpdatedAt:  time.Now(),
+		},
+	); err != nil {
+		log.Errorf("Can't write the cache %s: %s", ctx.Cache.Path, err.Error())
+	}
+
+	return result, indexes
+}
+
+func (ctx *Context) logNamespaceOutcomes(indexes map[string]uint64, errs map[string]error) {
+	for _, namespace := range ctx.Namespaces {
+		if err, ok := errs[namespace]; ok {
+			log.Errorf("Namespace %s can't be read: %s", namespace, err.Error())
+		} else {
+			log.Noticef("Namespace %s read at index %d", namespace, indexes[namespace])
+		}
+	}
+}
+
+// fetchStartupVariables fetches the environment the command is started
+// with, following the startup policy when some namespaces can't be read.
+func (ctx *Context) fetchStartupVariables() (map[string]string, map[string]uint64, error) {
+	deadline := time.Now().Add(ctx.StartupTimeout)
+
+	config := ctx.Backoff
+	config.MaxElapsedTime = 0
+
+	b := config.newBackOff()
+
+	for {
+		result, indexes, errs := ctx.fetchNamespaces()
+		ctx.logNamespaceOutcomes(indexes, errs)
+
+		if len(errs) == 0 {
+			result, indexes = ctx.withCache(result, indexes, errs)
+			return result, indexes, nil
+		}
+
+		switch ctx.StartupPolicy {
+		case StartupStrict:
+			return nil, nil, newError(ErrStartupFailed)
+		case StartupWait:
+			t := b.NextBackOff()
+
+			if ctx.StartupTimeout > 0 {
+				if remaining := deadline.Sub(time.Now()); remaining <= 0 {
+					log.Errorf("Startup timeout of %v reached", ctx.StartupTimeout)
+					return nil, nil, newError(ErrStartupFailed)
+				} else if remaining < t {
+					t = remaining
+				}
+			}
+
+			log.Noticef("Waiting %v for every namespace to be readable", t)
+
+			select {
+			case <-time.After(t):
+			case <-ctx.ExitChan:
+				return nil, nil, newError(ErrStartupAborted)
+			}
+		default:
+			log.Warning("Starting in degraded mode")
+			result, indexes = ctx.withCache(result, indexes, errs)
+			return result, indexes, nil
+		}
+	}
 }
 
 func (ctx *Context) shouldRestart(envVar, value string) bool {
@@ -120,80 +305,338 @@ func (ctx *Context) shouldRestart(envVar, value string) bool {
 		return false
 	}
 
-	if len(ctx.WatchedKeys) == 0 || containsString(ctx.WatchedKeys, envVar) {
-		return true
+	return ctx.actionFor(envVar).Type == ActionRestart
+}
+
+// shouldResync tells whether the environment fetched again from etcd
+// differs from the current one on a key the context cares about.
+func (ctx *Context) shouldResync(env map[string]string) bool {
+	for key, value := range env {
+		if ctx.shouldRestart(key, value) {
+			return true
+		}
+	}
+
+	for key := range ctx.CurrentEnv {
+		if _, ok := env[key]; !ok && ctx.shouldRestart(key, "") {
+			return true
+		}
 	}
 
 	return false
 }
 
-func (ctx *Context) Run() {
-	ctx.CurrentEnv = ctx.fetchEtcdVariables()
+func (ctx *Context) syncCluster(source ClusterSource) {
+	if err := source.SyncCluster(); err != nil {
+		log.Warningf("etcd cluster sync error: %s", err.Error())
+	}
+}
+
+// Run starts the command and restarts it whenever its environment changes,
+// until a value is sent to ExitChan or the command exits and the restart
+// policy doesn't restart it. The command is always stopped when Run returns the
+// status etcdenv should exit with.
+func (ctx *Context) Run() int {
+	clusterSource, isCluster := ctx.Source.(ClusterSource)
+
+	if isCluster {
+		ctx.syncCluster(clusterSource)
+
+		if ctx.SyncInterval > 0 {
+			go func() {
+				for range time.Tick(ctx.SyncInterval) {
+					ctx.syncCluster(clusterSource)
+				}
+			}()
+		}
+	}
+
+	env, indexes, err := ctx.fetchStartupVariables()
+
+	if isError(err, ErrStartupAborted) {
+		log.Notice("Startup aborted")
+		return 0
+	} else if err != nil {
+		log.Criticalf("The command is not started: %s", err.Error())
+		return 1
+	}
+
+	ctx.CurrentEnv = env
 	ctx.Runner.Start(ctx.CurrentEnv)
+	ctx.recordEnv()
 
-	responseChan := make(chan *etcd.Response)
-	processExitChan := make(chan int)
+	changeChan := make(chan *Change)
+	resyncChan := make(chan string)
+	restarts := ctx.Restart.tracker()
+
+	var (
+		startedAt         time.Time
+		restartTimer      <-chan time.Time
+		healthyTimer      <-chan time.Time
+		healthyGeneration uint64
+		batch             changeBatch
+	)
 
 	for _, namespace := range ctx.Namespaces {
-		go func(namespace string) {
-			var t time.Duration
-			b := backoff.NewExponentialBackOff()
-			b.Reset()
+		go func(namespace string, index uint64) {
+			var (
+				lastIndex uint64
+				err       error
+			)
+
+			b := ctx.Backoff.watchBackOff()
 
 			for {
-				resp, err := ctx.etcdClient.Watch(namespace, 0, true, nil, ctx.ExitChan)
+				lastIndex = index
+				index, err = ctx.Source.Watch(namespace, index, changeChan, ctx.stopChan)
 
-				if err != nil {
-					log.Errorf("etcd fetching error: %s", err.Error())
+				if isError(err, ErrWatchStopped) {
+					return
+				}
 
-					if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == etcd.ErrCodeEtcdNotReachable {
-						t = b.NextBackOff()
-						log.Noticef("Can't join the etcd server, wait %v", t)
-						time.Sleep(t)
-					}
+				if index != lastIndex {
+					// The watch went fine for a while, it is a new failure
+					b.Reset()
+				}
+
+				log.Errorf("etcd watching error: %s", err.Error())
 
-					if t == backoff.Stop {
-						return
-					} else {
-						continue
+				if isError(err, ErrIndexCleared) {
+					log.Noticef("etcd index of %s cleared, resyncing the namespace", namespace)
+
+					// Changes may have been missed, start again from now
+					// and compare the whole environment
+					if _, index, err = ctx.Source.Snapshot(namespace); err != nil {
+						index = 0
 					}
+
+					resyncChan <- namespace
+					continue
 				}
 
-				log.Infof("%s key changed", resp.Node.Key)
+				t := b.NextBackOff()
 
-				if ctx.shouldRestart(ctx.escapeNamespace(resp.Node.Key), resp.Node.Value) {
-					responseChan <- resp
+				if t == backoff.Stop {
+					log.Errorf("Stop watching %s", namespace)
+					return
 				}
+
+				if isError(err, ErrEtcdNotReachable) {
+					log.Noticef("Can't join the etcd server, wait %v", t)
+				} else {
+					log.Noticef("Watch again %s in %v", namespace, t)
+				}
+
+				time.Sleep(t)
 			}
-		}(namespace)
+		}(namespace, indexes[namespace])
 	}
 
-	go ctx.Runner.WatchProcess(processExitChan)
-
 	for {
 		select {
-		case <-responseChan:
+		case c := <-changeChan:
+			log.Infof("%s key changed", c.Key)
+
+			if namespace, ok := ctx.actionsNamespace(c.Key); ok {
+				log.Noticef("Actions of %s changed", namespace)
+				ctx.setNamespaceActions(namespace, c.Value)
+				continue
+			}
+
+			key := ctx.escapeNamespace(c.Key)
+
+			if action := ctx.actionFor(key); action.Type != ActionRestart {
+				oldValue, ok := ctx.seenEnv[key]
+
+				if !ok {
+					oldValue = ctx.CurrentEnv[key]
+				}
+
+				if oldValue != c.Value {
+					ctx.seenEnv[key] = c.Value
+					ctx.react(action, key, oldValue, c.Value)
+				}
+
+				continue
+			}
+
+			if !ctx.shouldRestart(key, c.Value) {
+				continue
+			}
+
+			batch.add(c.Key, ctx.Debounce, ctx.DebounceMaxWait)
+
+			if ctx.Debounce <= 0 {
+				ctx.applyChanges(&batch)
+			}
+		case <-batch.quiet:
+			ctx.applyChanges(&batch)
+		case <-batch.deadline:
+			ctx.applyChanges(&batch)
+		case namespace := <-resyncChan:
+			batch.reset()
+			env := ctx.fetchAllowedEnv()
+
+			if !ctx.shouldResync(env) {
+				log.Infof("%s resynced, environment unchanged", namespace)
+				continue
+			}
+
 			log.Notice("Environment changed, restarting child process..")
-			ctx.CurrentEnv = ctx.fetchEtcdVariables()
-			ctx.Runner.Restart(ctx.CurrentEnv)
-			log.Notice("Process restarted")
+			ctx.changeEnv(env)
+		case <-ctx.ReloadChan:
+			log.Notice("Reload asked, restarting child process..")
+			batch.reset()
+			ctx.changeEnv(ctx.fetchAllowedEnv())
 		case <-ctx.ExitChan:
 			log.Notice("Asking the runner to stop")
+			close(ctx.stopChan)
 			ctx.Runner.Stop()
-			os.Stderr.Sync()
 			log.Notice("Runner stopped")
-		case status := <-processExitChan:
-			log.Noticef("Child process exited with status %d", status)
-			if ctx.ShutdownBehaviour == "exit" {
-				ctx.ExitChan <- true
-				os.Stderr.Sync()
-				os.Exit(status)
-			} else if ctx.ShutdownBehaviour == "restart" {
-				ctx.CurrentEnv = ctx.fetchEtcdVariables()
-				ctx.Runner.Restart(ctx.CurrentEnv)
-				go ctx.Runner.WatchProcess(processExitChan)
-				log.Notice("Process restarted")
+			return ctx.Runner.LastExitStatus()
+		case <-restartTimer:
+			restartTimer = nil
+			ctx.CurrentEnv = ctx.fetchAllowedEnv()
+			ctx.restart()
+		case <-healthyTimer:
+			healthyTimer = nil
+			ctx.markHealthy(healthyGeneration)
+		case e := <-ctx.Runner.Events():
+			switch e.Type {
+			case EventStarted, EventRestarted:
+				log.Infof("Child process %s, generation %d, pid %d", e.Type, e.Generation, e.Pid)
+				startedAt = time.Now()
+				restartTimer = nil
+				continue
+			case EventReady:
+				log.Infof("Child process ready, generation %d, pid %d", e.Generation, e.Pid)
+
+				if ctx.RollbackWindow > 0 {
+					healthyTimer = time.After(ctx.RollbackWindow)
+					healthyGeneration = e.Generation
+				}
+
+				continue
+			case EventUnhealthy:
+				log.Errorf("Child process unhealthy, generation %d: %s", e.Generation, e.Err.Error())
+				continue
+			case EventFailed:
+				log.Errorf("Child process can't be started: %s", e.Err.Error())
+			case EventExited:
+				if e.Stopped {
+					continue
+				}
+			}
+
+			if e.Discarded {
+				// The previous generation keeps running, no restart needed
+				log.Noticef("Child process of generation %d discarded, status %d", e.Generation, e.Status)
+				ctx.discard(e)
+				continue
 			}
+
+			if e.Generation != ctx.Runner.Generation() {
+				// The process crashed while being replaced
+				log.Noticef("Child process of generation %d exited with status %d", e.Generation, e.Status)
+				continue
+			}
+
+			if e.Type == EventExited {
+				log.Noticef("Child process exited with status %d", e.Status)
+			}
+
+			healthyTimer = nil
+
+			if ctx.rollback(e) {
+				continue
+			}
+
+			if !ctx.RestartPolicy.shouldRestart(e) {
+				if !ctx.RestartPolicy.exits() {
+					continue
+				}
+
+				close(ctx.stopChan)
+				ctx.Runner.Stop()
+
+				if e.Err != nil && e.Status == 0 {
+					// Stopped by its probe, the process didn't exit cleanly
+					return 1
+				}
+
+				return e.Status
+			}
+
+			var uptime time.Duration
+
+			if e.Type == EventExited {
+				uptime = time.Since(startedAt)
+			}
+
+			t, ok := restarts.next(uptime, time.Now())
+
+			if !ok {
+				log.Criticalf(
+					"Child process restarted %d times within %v, giving up",
+					ctx.Restart.MaxRestarts,
+					ctx.Restart.Window,
+				)
+				close(ctx.stopChan)
+				ctx.Runner.Stop()
+				return ExitRestartLimit
+			}
+
+			if t == 0 {
+				ctx.CurrentEnv = ctx.fetchAllowedEnv()
+				ctx.restart()
+				continue
+			}
+
+			// Don't hammer a command which keeps crashing
+			log.Noticef("Child process is crashing, restart it in %v", t)
+			restartTimer = time.After(t)
+		}
+	}
+}
+
+// applyChanges fetches the environment again and restarts the process
+// once for all the changes of the batch.
+func (ctx *Context) applyChanges(batch *changeBatch) {
+	keys := batch.keys
+	batch.reset()
+
+	env := ctx.fetchAllowedEnv()
+
+	if !ctx.shouldResync(env) {
+		log.Infof("Environment unchanged after changes of %s", strings.Join(keys, ", "))
+		return
+	}
+
+	log.Noticef("Environment changed by %s, restarting child process..", strings.Join(keys, ", "))
+	ctx.changeEnv(env)
+}
+
+// restart restarts the process with the current environment, a failure is
+// reported by the runner events.
+func (ctx *Context) restart() {
+	err := ctx.Runner.Restart(ctx.CurrentEnv)
+	ctx.recordEnv()
+
+	if err != nil {
+		return
+	}
+
+	log.Notice("Process restarted")
+}
+
+// recordEnv remembers the environment of the last spawned generation, the
+// ones of the replaced generations are dropped.
+func (ctx *Context) recordEnv() {
+	ctx.envs[ctx.Runner.LastGeneration()] = ctx.CurrentEnv
+
+	for generation := range ctx.envs {
+		if generation < ctx.Runner.Generation() {
+			delete(ctx.envs, generation)
 		}
 	}
 }
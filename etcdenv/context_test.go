@@ -0,0 +1,218 @@
+package etcdenv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearedSource fails the first watch like a compacted etcd once
+// released, the value changing in between.
+type clearedSource struct {
+	*MemorySource
+	key, value string
+	release    chan struct{}
+	cleared    bool
+}
+
+func (s *clearedSource) Watch(namespace string, index uint64, changes chan<- *Change, stop chan bool) (uint64, error) {
+	if !s.cleared {
+		s.cleared = true
+
+		select {
+		case <-s.release:
+		case <-stop:
+			return index, newError(ErrWatchStopped)
+		}
+
+		s.Set(s.key, s.value)
+		s.Compact()
+
+		return index, newError(ErrIndexCleared)
+	}
+
+	return s.MemorySource.Watch(namespace, index, changes, stop)
+}
+
+// runContext runs a context whose command appends the variable to a file
+// on every start and exits at once when the variable is crash, it returns
+// the file and a function stopping the context.
+func runContext(t *testing.T, source Source, variable string, configure ...func(*Context)) (string, func() int) {
+	output := filepath.Join(t.TempDir(), "output")
+
+	ctx, err := NewContext(
+		[]string{"/test"},
+		source,
+		[]string{
+			"/bin/sh",
+			"-c",
+			fmt.Sprintf(`echo "$%[1]s" >> %[2]s; test "$%[1]s" = crash && exit 1; exec sleep 60`, variable, output),
+		},
+		RestartPolicy{Mode: RestartAlways},
+		nil,
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fn := range configure {
+		fn(ctx)
+	}
+
+	status := make(chan int)
+
+	go func() { status <- ctx.Run() }()
+
+	return output, func() int {
+		ctx.ExitChan <- true
+		return <-status
+	}
+}
+
+// waitOutput waits until the command wrote the expected lines.
+func waitOutput(t *testing.T, output string, lines ...string) {
+	expected := strings.Join(lines, "\n") + "\n"
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		content, _ := ioutil.ReadFile(output)
+
+		if string(content) == expected {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected output %q, got %q", expected, content)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestContextRestartsOnChange(t *testing.T) {
+	source := NewMemorySource()
+	source.Set("/test/FOO", "bar")
+
+	output, stop := runContext(t, source, "FOO")
+	defer stop()
+
+	waitOutput(t, output, "bar")
+
+	source.Set("/test/FOO", "baz")
+	waitOutput(t, output, "bar", "baz")
+
+	// Setting the same value again is not a change of the environment
+	source.Set("/test/FOO", "baz")
+	source.Set("/test/FOO", "qux")
+	waitOutput(t, output, "bar", "baz", "qux")
+}
+
+func TestContextFlattensNestedKeys(t *testing.T) {
+	source := NewMemorySource()
+	source.Set("/test/db/host", "db1")
+
+	output, stop := runContext(t, source, "db_host")
+	defer stop()
+
+	waitOutput(t, output, "db1")
+
+	source.Set("/test/db/host", "db2")
+	waitOutput(t, output, "db1", "db2")
+}
+
+func TestContextResyncsOnIndexCleared(t *testing.T) {
+	source := &clearedSource{
+		MemorySource: NewMemorySource(),
+		key:          "/test/FOO",
+		value:        "baz",
+		release:      make(chan struct{}),
+	}
+	source.Set("/test/FOO", "bar")
+
+	output, stop := runContext(t, source, "FOO")
+	defer stop()
+
+	waitOutput(t, output, "bar")
+	close(source.release)
+
+	// The change is only seen by the snapshot following the cleared index
+	waitOutput(t, output, "bar", "baz")
+}
+
+func TestMemorySourceTrimsHistory(t *testing.T) {
+	source := NewMemorySource()
+
+	for i := 0; i < 3*memorySourceHistory; i++ {
+		source.Set("/test/FOO", fmt.Sprint(i))
+	}
+
+	if n := len(source.history); n < memorySourceHistory || n >= 2*memorySourceHistory {
+		t.Errorf("Unexpected history length %d", n)
+	}
+
+	changes := make(chan *Change, 1)
+
+	if _, err := source.Watch("/test", 1, changes, make(chan bool)); !isError(err, ErrIndexCleared) {
+		t.Errorf("Expected an index cleared error, got %v", err)
+	}
+}
+
+func TestContextKeepsPreviousGenerationOnDiscard(t *testing.T) {
+	source := NewMemorySource()
+	source.Set("/test/FOO", "bar")
+
+	output, stop := runContext(t, source, "FOO", func(ctx *Context) {
+		ctx.RollbackWindow = 100 * time.Millisecond
+		ctx.Runner.Overlap = true
+		ctx.Runner.ReadinessProbe = &Probe{
+			Target:           `exec:test "$FOO" != crash`,
+			Interval:         50 * time.Millisecond,
+			Timeout:          time.Second,
+			FailureThreshold: 100,
+		}
+	})
+	defer stop()
+
+	waitOutput(t, output, "bar")
+
+	// Let the first generation run healthily for the rollback window
+	time.Sleep(300 * time.Millisecond)
+
+	source.Set("/test/FOO", "crash")
+	waitOutput(t, output, "bar", "crash")
+
+	// The first generation keeps running, it is neither restarted nor
+	// replaced by a change back to the faulty value
+	time.Sleep(300 * time.Millisecond)
+	source.Set("/test/FOO", "crash")
+	time.Sleep(300 * time.Millisecond)
+	waitOutput(t, output, "bar", "crash")
+
+	source.Set("/test/FOO", "baz")
+	waitOutput(t, output, "bar", "crash", "baz")
+}
+
+func TestContextNamespaceActions(t *testing.T) {
+	source := NewMemorySource()
+	source.Set("/test/FOO", "bar")
+	source.Set("/test/"+ActionsKey, "FOO ignore")
+
+	output, stop := runContext(t, source, "FOO")
+	defer stop()
+
+	waitOutput(t, output, "bar")
+
+	// Ignored by the actions read at startup
+	source.Set("/test/FOO", "baz")
+	time.Sleep(300 * time.Millisecond)
+	waitOutput(t, output, "bar")
+
+	// The actions key is watched like the variables
+	source.Set("/test/"+ActionsKey, "FOO restart")
+	source.Set("/test/FOO", "qux")
+	waitOutput(t, output, "bar", "qux")
+}
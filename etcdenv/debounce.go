@@ -0,0 +1,36 @@
+package etcdenv
+
+import "time"
+
+const DefaultDebounceMaxWait = 10 * time.Second
+
+// changeBatch gathers the changed keys until the changes settle down. It
+// is flushed once no change happened during the quiet period, or once the
+// maximum wait is reached since its first change.
+type changeBatch struct {
+	keys     []string
+	quiet    <-chan time.Time
+	deadline <-chan time.Time
+}
+
+func (b *changeBatch) add(key string, quiet, maxWait time.Duration) {
+	if !containsString(b.keys, key) {
+		b.keys = append(b.keys, key)
+	}
+
+	if quiet <= 0 {
+		return
+	}
+
+	b.quiet = time.After(quiet)
+
+	if b.deadline == nil && maxWait > 0 {
+		b.deadline = time.After(maxWait)
+	}
+}
+
+func (b *changeBatch) reset() {
+	b.keys = nil
+	b.quiet = nil
+	b.deadline = nil
+}
@@ -4,12 +4,27 @@ const (
 	ErrKeyNotFound    = 100
 	ErrAlreadyStarted = iota
 	ErrNotStarted
+	ErrEtcdNotReachable
+	ErrWatchStopped
+	ErrIndexCleared
+	ErrStartupFailed
+	ErrStartupAborted
+	ErrCommandNotFound
+	ErrStartFailed
 )
 
 var (
 	errorMap = map[int]string{
-		ErrAlreadyStarted: "The process is already started",
-		ErrNotStarted:     "The process is not started yet",
+		ErrKeyNotFound:      "The namespace does not exist",
+		ErrAlreadyStarted:   "The process is already started",
+		ErrNotStarted:       "The process is not started yet",
+		ErrEtcdNotReachable: "All the given etcd peers are not reachable",
+		ErrWatchStopped:     "The watch has been stopped",
+		ErrIndexCleared:     "The watched index has been cleared by etcd",
+		ErrStartupFailed:    "Some namespaces can't be read",
+		ErrStartupAborted:   "The startup has been aborted",
+		ErrCommandNotFound:  "command not found",
+		ErrStartFailed:      "The process can't be started",
 	}
 )
 
@@ -25,3 +40,9 @@ func (e EtcdenvError) Error() string {
 func newError(errorCode int) *EtcdenvError {
 	return &EtcdenvError{ErrorCode: errorCode, Message: errorMap[errorCode]}
 }
+
+func isError(err error, errorCode int) bool {
+	e, ok := err.(*EtcdenvError)
+
+	return ok && e.ErrorCode == errorCode
+}
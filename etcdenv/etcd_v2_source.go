@@ -0,0 +1,192 @@
+package etcdenv
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/upfluence/goutils/log"
+)
+
+const etcdV2ErrCodeEventIndexCleared = 401
+
+type EtcdV2Source struct {
+	members   *members
+	username  string
+	password  string
+	tlsConfig *tls.Config
+
+	clientsMu sync.Mutex
+	clients   map[string]*etcd.Client
+}
+
+func NewEtcdV2Source(endpoints []string, username, password string,
+	tlsConfig *TLSConfig) (*EtcdV2Source, error) {
+	config, err := buildTLSConfig(tlsConfig)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &EtcdV2Source{
+		members:   newMembers(endpoints),
+		username:  username,
+		password:  password,
+		tlsConfig: config,
+		clients:   make(map[string]*etcd.Client),
+	}, nil
+}
+
+func (s *EtcdV2Source) newClient(endpoints []string) *etcd.Client {
+	client := etcd.NewClient(endpoints)
+
+	if s.tlsConfig != nil {
+		client.SetTransport(newHTTPTransport(s.tlsConfig))
+	}
+
+	if s.username != "" && s.password != "" {
+		client.SetCredentials(s.username, s.password)
+	}
+
+	return client
+}
+
+// client returns the client bound to a single member, the failover between
+// members being handled by the source.
+func (s *EtcdV2Source) client(member string) *etcd.Client {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	client, ok := s.clients[member]
+
+	if !ok {
+		client = s.newClient([]string{member})
+		client.CheckRetry = etcdV2CheckRetry
+		s.clients[member] = client
+	}
+
+	return client
+}
+
+// etcdV2CheckRetry gives up on the first network error, instead of
+// returning the raw error, so the source can move to the next member.
+func etcdV2CheckRetry(cluster *etcd.Cluster, numReqs int, lastResp http.Response, err error) error {
+	if lastResp.StatusCode == 0 {
+		return &etcd.EtcdError{
+			ErrorCode: etcd.ErrCodeEtcdNotReachable,
+			Message:   "etcd member not reachable",
+			Cause:     err.Error(),
+		}
+	}
+
+	return etcd.DefaultCheckRetry(cluster, numReqs, lastResp, err)
+}
+
+func (s *EtcdV2Source) SyncCluster() error {
+	client := s.newClient(s.members.all())
+	defer client.Close()
+
+	if !client.SyncCluster() {
+		return newError(ErrEtcdNotReachable)
+	}
+
+	s.members.set(client.GetCluster())
+
+	return nil
+}
+
+func (s *EtcdV2Source) Snapshot(namespace string) (map[string]string, uint64, error) {
+	var lastErr error = newError(ErrEtcdNotReachable)
+
+	for _, member := range s.members.all() {
+		response, err := s.client(member).Get(namespace, false, true)
+
+		if err != nil {
+			if lastErr = translateEtcdV2Error(err); isError(lastErr, ErrEtcdNotReachable) {
+				s.members.failure(member)
+				continue
+			}
+
+			return nil, 0, lastErr
+		}
+
+		result := make(map[string]string)
+
+		collectEtcdV2Nodes(response.Node.Nodes, result)
+
+		return result, response.EtcdIndex, nil
+	}
+
+	return nil, 0, lastErr
+}
+
+func collectEtcdV2Nodes(nodes etcd.Nodes, result map[string]string) {
+	for _, node := range nodes {
+		if node.Dir {
+			collectEtcdV2Nodes(node.Nodes, result)
+		} else {
+			result[node.Key] = node.Value
+		}
+	}
+}
+
+func (s *EtcdV2Source) Watch(namespace string, index uint64, changes chan<- *Change, stop chan bool) (uint64, error) {
+	member := s.members.pick()
+
+	log.Infof("Watching %s on %s", namespace, member)
+
+	for {
+		var waitIndex uint64
+
+		if index > 0 {
+			waitIndex = index + 1
+		}
+
+		resp, err := s.client(member).Watch(namespace, waitIndex, true, nil, stop)
+
+		if err != nil {
+			err = translateEtcdV2Error(err)
+
+			if isError(err, ErrEtcdNotReachable) {
+				s.members.failure(member)
+			}
+
+			return index, err
+		}
+
+		index = resp.Node.ModifiedIndex
+
+		changes <- &Change{Key: resp.Node.Key, Value: resp.Node.Value, Index: index}
+	}
+}
+
+func (s *EtcdV2Source) Close() error {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	for _, client := range s.clients {
+		client.Close()
+	}
+
+	return nil
+}
+
+func translateEtcdV2Error(err error) error {
+	if err == etcd.ErrWatchStoppedByUser {
+		return newError(ErrWatchStopped)
+	}
+
+	if e, ok := err.(*etcd.EtcdError); ok {
+		switch e.ErrorCode {
+		case etcd.ErrCodeEtcdNotReachable:
+			return newError(ErrEtcdNotReachable)
+		case ErrKeyNotFound:
+			return newError(ErrKeyNotFound)
+		case etcdV2ErrCodeEventIndexCleared:
+			return newError(ErrIndexCleared)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,399 @@
+package etcdenv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/upfluence/goutils/log"
+)
+
+// The v3 source talks to the JSON gateway exposed by every etcd v3 member
+// in front of its gRPC API, which keeps etcdenv free of the gRPC stack.
+const etcdV3APIPrefix = "/v3"
+
+type EtcdV3Source struct {
+	members    *members
+	username   string
+	password   string
+	httpClient *http.Client
+
+	tokenMu sync.Mutex
+	token   string
+}
+
+type etcdV3ResponseHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdV3KeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+type etcdV3RangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcdV3RangeResponse struct {
+	Header etcdV3ResponseHeader `json:"header"`
+	Kvs    []*etcdV3KeyValue    `json:"kvs"`
+}
+
+type etcdV3WatchCreateRequest struct {
+	Key           []byte `json:"key"`
+	RangeEnd      []byte `json:"range_end,omitempty"`
+	StartRevision int64  `json:"start_revision,omitempty"`
+}
+
+type etcdV3WatchRequest struct {
+	CreateRequest etcdV3WatchCreateRequest `json:"create_request"`
+}
+
+type etcdV3Event struct {
+	Type string          `json:"type"`
+	Kv   *etcdV3KeyValue `json:"kv"`
+}
+
+type etcdV3WatchResponse struct {
+	Result *struct {
+		Header          etcdV3ResponseHeader `json:"header"`
+		Canceled        bool                 `json:"canceled"`
+		CancelReason    string               `json:"cancel_reason"`
+		CompactRevision int64                `json:"compact_revision,string"`
+		Events          []*etcdV3Event       `json:"events"`
+	} `json:"result"`
+	Error *etcdV3Error `json:"error"`
+}
+
+type etcdV3MemberListResponse struct {
+	Members []struct {
+		ClientURLs []string `json:"clientURLs"`
+	} `json:"members"`
+}
+
+type etcdV3AuthRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type etcdV3AuthResponse struct {
+	Token string `json:"token"`
+}
+
+// grpcCodeUnauthenticated is returned by the gateway when the auth token
+// is missing or has expired.
+const grpcCodeUnauthenticated = 16
+
+type etcdV3Error struct {
+	StatusCode int    `json:"-"`
+	Code       int    `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *etcdV3Error) Error() string {
+	return fmt.Sprintf("etcd v3 error %d: %s", e.Code, e.Message)
+}
+
+func NewEtcdV3Source(endpoints []string, username, password string,
+	tlsConfig *TLSConfig) (*EtcdV3Source, error) {
+	config, err := buildTLSConfig(tlsConfig)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &EtcdV3Source{
+		members:    newMembers(endpoints),
+		username:   username,
+		password:   password,
+		httpClient: &http.Client{Transport: newHTTPTransport(config)},
+	}, nil
+}
+
+func (s *EtcdV3Source) SyncCluster() error {
+	var response etcdV3MemberListResponse
+
+	resp, err := s.post(context.Background(), "/cluster/member/list", struct{}{})
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return err
+	}
+
+	var urls []string
+
+	for _, member := range response.Members {
+		urls = append(urls, member.ClientURLs...)
+	}
+
+	s.members.set(urls)
+
+	return nil
+}
+
+func (s *EtcdV3Source) Close() error {
+	s.httpClient.CloseIdleConnections()
+
+	return nil
+}
+
+// etcdV3Prefix returns the key prefix holding the descendants of the
+// namespace and the matching range end, as expected by the v3 API.
+func etcdV3Prefix(namespace string) ([]byte, []byte) {
+	prefix := []byte(namespacePrefix(namespace))
+	rangeEnd := make([]byte, len(prefix))
+	copy(rangeEnd, prefix)
+
+	for i := len(rangeEnd) - 1; i >= 0; i-- {
+		if rangeEnd[i] < 0xff {
+			rangeEnd[i]++
+			return prefix, rangeEnd[:i+1]
+		}
+	}
+
+	return prefix, []byte{0}
+}
+
+func (s *EtcdV3Source) authenticate(ctx context.Context) error {
+	var response etcdV3AuthResponse
+
+	resp, err := s.do(
+		ctx,
+		"/auth/authenticate",
+		&etcdV3AuthRequest{Name: s.username, Password: s.password},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return err
+	}
+
+	s.setToken(response.Token)
+
+	return nil
+}
+
+func (s *EtcdV3Source) getToken() string {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	return s.token
+}
+
+func (s *EtcdV3Source) setToken(token string) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	s.token = token
+}
+
+func (s *EtcdV3Source) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	if s.username != "" && s.password != "" && s.getToken() == "" {
+		if err := s.authenticate(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := s.do(ctx, path, body)
+
+	if e, ok := err.(*etcdV3Error); ok &&
+		(e.StatusCode == http.StatusUnauthorized || e.Code == grpcCodeUnauthenticated) {
+		// The token has probably expired, fetch a new one on the next call
+		s.setToken("")
+	}
+
+	return resp, err
+}
+
+func (s *EtcdV3Source) do(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, endpoint := range s.members.all() {
+		req, err := http.NewRequest(
+			"POST",
+			strings.TrimSuffix(endpoint, "/")+etcdV3APIPrefix+path,
+			bytes.NewReader(payload),
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+
+		if token := s.getToken(); token != "" {
+			req.Header.Set("Authorization", token)
+		}
+
+		resp, err := s.httpClient.Do(req)
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, newError(ErrWatchStopped)
+			}
+
+			log.Warningf("etcd member %s not reachable: %s", endpoint, err.Error())
+			s.members.failure(endpoint)
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			e := &etcdV3Error{StatusCode: resp.StatusCode}
+			json.NewDecoder(resp.Body).Decode(e)
+			resp.Body.Close()
+
+			return nil, e
+		}
+
+		return resp, nil
+	}
+
+	return nil, newError(ErrEtcdNotReachable)
+}
+
+func (s *EtcdV3Source) Snapshot(namespace string) (map[string]string, uint64, error) {
+	var response etcdV3RangeResponse
+
+	prefix, rangeEnd := etcdV3Prefix(namespace)
+
+	resp, err := s.post(
+		context.Background(),
+		"/kv/range",
+		&etcdV3RangeRequest{Key: prefix, RangeEnd: rangeEnd},
+	)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, 0, err
+	}
+
+	if len(response.Kvs) == 0 {
+		return nil, 0, newError(ErrKeyNotFound)
+	}
+
+	result := make(map[string]string)
+
+	for _, kv := range response.Kvs {
+		result[string(kv.Key)] = string(kv.Value)
+	}
+
+	return result, uint64(response.Header.Revision), nil
+}
+
+func (s *EtcdV3Source) Watch(namespace string, index uint64, changes chan<- *Change, stop chan bool) (uint64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	defer close(done)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-done:
+		}
+	}()
+
+	prefix, rangeEnd := etcdV3Prefix(namespace)
+
+	request := &etcdV3WatchRequest{
+		CreateRequest: etcdV3WatchCreateRequest{Key: prefix, RangeEnd: rangeEnd},
+	}
+
+	if index > 0 {
+		request.CreateRequest.StartRevision = int64(index) + 1
+	}
+
+	resp, err := s.post(ctx, "/watch", request)
+
+	if err != nil {
+		return index, err
+	}
+
+	defer resp.Body.Close()
+
+	// The request may have failed over to another member
+	log.Infof("Watching %s on %s://%s", namespace, resp.Request.URL.Scheme, resp.Request.URL.Host)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var response etcdV3WatchResponse
+
+		if err := json.Unmarshal(scanner.Bytes(), &response); err != nil {
+			return index, err
+		}
+
+		if response.Error != nil {
+			return index, response.Error
+		}
+
+		if response.Result == nil {
+			continue
+		}
+
+		if response.Result.CompactRevision > 0 {
+			return index, newError(ErrIndexCleared)
+		}
+
+		if response.Result.Canceled {
+			return index, fmt.Errorf("etcd v3 watch canceled: %s", response.Result.CancelReason)
+		}
+
+		for _, event := range response.Result.Events {
+			if event.Kv == nil {
+				continue
+			}
+
+			index = uint64(event.Kv.ModRevision)
+			c := &Change{Key: string(event.Kv.Key), Index: index}
+
+			// PUT is the zero value of the event type and is omitted
+			if event.Type != "DELETE" {
+				c.Value = string(event.Kv.Value)
+			}
+
+			changes <- c
+		}
+	}
+
+	if ctx.Err() != nil {
+		return index, newError(ErrWatchStopped)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return index, err
+	}
+
+	return index, newError(ErrEtcdNotReachable)
+}
@@ -0,0 +1,136 @@
+package etcdenv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEtcdV3Prefix(t *testing.T) {
+	for _, tt := range []struct {
+		namespace, prefix, rangeEnd string
+	}{
+		{"/test", "/test/", "/test0"},
+		{"/test/", "/test/", "/test0"},
+		{"/a/b", "/a/b/", "/a/b0"},
+		{"", "/", "0"},
+	} {
+		prefix, rangeEnd := etcdV3Prefix(tt.namespace)
+
+		if string(prefix) != tt.prefix || string(rangeEnd) != tt.rangeEnd {
+			t.Errorf(
+				"etcdV3Prefix(%q) = %q, %q, expected %q, %q",
+				tt.namespace,
+				prefix,
+				rangeEnd,
+				tt.prefix,
+				tt.rangeEnd,
+			)
+		}
+	}
+}
+
+// watchServer answers the watches with the given lines, checking the
+// revision the watch starts from.
+func watchServer(t *testing.T, startRevision int64, lines ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request etcdV3WatchRequest
+
+		if r.URL.Path != etcdV3APIPrefix+"/watch" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Invalid watch request: %s", err.Error())
+		}
+
+		if string(request.CreateRequest.Key) != "/test/" ||
+			string(request.CreateRequest.RangeEnd) != "/test0" {
+			t.Errorf("Unexpected watched range %q, %q", request.CreateRequest.Key, request.CreateRequest.RangeEnd)
+		}
+
+		if request.CreateRequest.StartRevision != startRevision {
+			t.Errorf("Expected start revision %d, got %d", startRevision, request.CreateRequest.StartRevision)
+		}
+
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+			w.(http.Flusher).Flush()
+		}
+	}))
+}
+
+func base64String(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestEtcdV3SourceWatch(t *testing.T) {
+	server := watchServer(
+		t,
+		3,
+		`{"result":{"header":{"revision":"2"},"created":true}}`,
+		fmt.Sprintf(
+			`{"result":{"header":{"revision":"4"},"events":[{"kv":{"key":%q,"value":%q,"mod_revision":"3"}},{"type":"DELETE","kv":{"key":%q,"mod_revision":"4"}}]}}`,
+			base64String("/test/FOO"),
+			base64String("bar"),
+			base64String("/test/BAR"),
+		),
+	)
+	defer server.Close()
+
+	source, err := NewEtcdV3Source([]string{server.URL}, "", "", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan *Change, 2)
+	index, err := source.Watch("/test", 2, changes, make(chan bool))
+
+	// The stream closed by the server is handled like a lost member
+	if !isError(err, ErrEtcdNotReachable) {
+		t.Errorf("Expected a not reachable error, got %v", err)
+	}
+
+	if index != 4 {
+		t.Errorf("Expected the index 4, got %d", index)
+	}
+
+	for _, expected := range []Change{
+		{Key: "/test/FOO", Value: "bar", Index: 3},
+		{Key: "/test/BAR", Index: 4},
+	} {
+		if c := <-changes; *c != expected {
+			t.Errorf("Expected the change %+v, got %+v", expected, *c)
+		}
+	}
+}
+
+func TestEtcdV3SourceWatchCompacted(t *testing.T) {
+	server := watchServer(
+		t,
+		3,
+		`{"result":{"header":{"revision":"9"},"canceled":true,"compact_revision":"5","cancel_reason":"compacted"}}`,
+	)
+	defer server.Close()
+
+	source, err := NewEtcdV3Source([]string{server.URL}, "", "", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := source.Watch("/test", 2, make(chan *Change), make(chan bool))
+
+	if !isError(err, ErrIndexCleared) {
+		t.Errorf("Expected an index cleared error, got %v", err)
+	}
+
+	if index != 2 {
+		t.Errorf("Expected the index 2, got %d", index)
+	}
+}
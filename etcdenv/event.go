@@ -0,0 +1,51 @@
+package etcdenv
+
+import "os"
+
+// EventType is the kind of lifecycle event emitted by the runner.
+type EventType int
+
+const (
+	EventStarted EventType = iota
+	EventExited
+	EventRestarted
+	EventFailed
+	EventReady
+	EventUnhealthy
+)
+
+var eventTypeNames = map[EventType]string{
+	EventStarted:   "started",
+	EventExited:    "exited",
+	EventRestarted: "restarted",
+	EventFailed:    "failed",
+	EventReady:     "ready",
+	EventUnhealthy: "unhealthy",
+}
+
+func (t EventType) String() string {
+	return eventTypeNames[t]
+}
+
+// Event describes a change of state of a child instance. Every started
+// process gets a new generation number, an exit is always reported with
+// the generation of the process which exited.
+type Event struct {
+	Type       EventType
+	Generation uint64
+	Pid        int
+	// Status is the exit status of the process, only set on exit and on
+	// failure
+	Status int
+	// Signal is the signal which killed the process, if any
+	Signal os.Signal
+	// Err is the reason why the process couldn't be started or failed its
+	// probe, it is kept on the exit of a process stopped by its probe
+	Err error
+	// Stopped tells the process exited because the runner stopped it, on
+	// shutdown or on restart
+	Stopped bool
+	// Discarded tells the process exited or failed to start before
+	// replacing the previous generation, which keeps running
+	Discarded bool
+}
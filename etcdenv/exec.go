@@ -0,0 +1,36 @@
+package etcdenv
+
+import (
+	"os/exec"
+	"syscall"
+
+	"github.com/upfluence/goutils/log"
+)
+
+// Exec fetches the environment once and replaces etcdenv with the command,
+// nothing is watched. It only returns the status etcdenv should exit with
+// when the command can't be executed.
+func (ctx *Context) Exec() int {
+	if clusterSource, ok := ctx.Source.(ClusterSource); ok {
+		ctx.syncCluster(clusterSource)
+	}
+
+	env, _, err := ctx.fetchStartupVariables()
+
+	if err != nil {
+		log.Criticalf("The command is not started: %s", err.Error())
+		return 1
+	}
+
+	command := ctx.Runner.Command
+	path, err := exec.LookPath(command[0])
+
+	if err == nil {
+		err = syscall.Exec(path, command, ctx.Runner.buildEnvs(env))
+	}
+
+	failure := ctx.Runner.failure(startError(command[0], err))
+	log.Criticalf("The command can't be executed: %s", failure.Err.Error())
+
+	return failure.Status
+}
@@ -0,0 +1,135 @@
+package etcdenv
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/upfluence/goutils/log"
+)
+
+const prSetChildSubreaper = 36
+
+// ReapOrphans makes etcdenv act as an init process: the orphaned
+// descendants reparented to etcdenv are reaped whenever a SIGCHLD is
+// received. The processes of the runner are left to its own Wait. When
+// etcdenv is not PID 1, it becomes the subreaper of its descendants.
+func ReapOrphans(runner *Runner) {
+	if os.Getpid() != 1 {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0)
+
+		if errno != 0 {
+			log.Warningf("Can't become the subreaper of the child processes: %s", errno.Error())
+		}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGCHLD)
+
+	for range sigChan {
+		for _, pid := range zombieChildren() {
+			if runner.owns(pid) {
+				continue
+			}
+
+			var status syscall.WaitStatus
+
+			if wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && wpid == pid {
+				log.Infof("Orphaned process %d reaped", pid)
+			}
+		}
+	}
+}
+
+// zombieChildren lists the exited children of etcdenv which are not
+// waited yet. Waiting for any child would steal the status of the
+// runner's processes.
+func zombieChildren() []int {
+	var result []int
+
+	self := os.Getpid()
+
+	for pid, fields := range processStats() {
+		if fields[0] != "Z" {
+			continue
+		}
+
+		if ppid, _ := strconv.Atoi(fields[1]); ppid == self {
+			result = append(result, pid)
+		}
+	}
+
+	return result
+}
+
+// groupAlive tells whether a member of the process group is still
+// running. The zombies are left out, they are gone already but stay
+// listed until their parent, possibly not etcdenv, waits for them.
+func groupAlive(pgid int) bool {
+	if syscall.Kill(-pgid, 0) != nil {
+		return false
+	}
+
+	for _, fields := range processStats() {
+		if pgrp, _ := strconv.Atoi(fields[2]); pgrp == pgid && fields[0] != "Z" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// terminalForeground tells whether stdin is the controlling terminal of
+// etcdenv, with etcdenv in its foreground process group.
+func terminalForeground() bool {
+	var pgrp int32
+
+	_, _, errno := syscall.RawSyscall(
+		syscall.SYS_IOCTL,
+		uintptr(syscall.Stdin),
+		syscall.TIOCGPGRP,
+		uintptr(unsafe.Pointer(&pgrp)),
+	)
+
+	return errno == 0 && int(pgrp) == syscall.Getpgrp()
+}
+
+// processStats reads the stat fields following the command name of every
+// process: the state, the parent pid, the process group and so on.
+func processStats() map[int][]string {
+	result := make(map[int][]string)
+
+	entries, err := ioutil.ReadDir("/proc")
+
+	if err != nil {
+		log.Errorf("Can't list the processes: %s", err.Error())
+		return result
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+
+		if err != nil {
+			continue
+		}
+
+		stat, err := ioutil.ReadFile("/proc/" + entry.Name() + "/stat")
+
+		if err != nil {
+			continue
+		}
+
+		// The command name between parentheses may contain spaces
+		fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+
+		if len(fields) >= 3 {
+			result[pid] = fields
+		}
+	}
+
+	return result
+}
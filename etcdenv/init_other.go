@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package etcdenv
+
+import (
+	"syscall"
+
+	"github.com/upfluence/goutils/log"
+)
+
+// ReapOrphans is only supported on Linux.
+func ReapOrphans(runner *Runner) {
+	log.Warning("The init mode is only supported on Linux")
+}
+
+// terminalForeground is only supported on Linux, the processes stay in
+// the background.
+func terminalForeground() bool {
+	return false
+}
+
+// groupAlive tells whether a member of the process group still exists.
+func groupAlive(pgid int) bool {
+	return syscall.Kill(-pgid, 0) == nil
+}
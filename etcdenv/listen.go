@@ -0,0 +1,95 @@
+package etcdenv
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenShimArg makes etcdenv exec the command right away, once the
+// LISTEN_PID variable is set to its pid which is kept by the exec.
+const listenShimArg = "-etcdenv-listen-shim"
+
+// Listen binds the address, either tcp://host:port, unix:///path or
+// host:port, and returns the listening socket to hand over to the
+// process.
+func Listen(address string) (*os.File, error) {
+	network, addr := "tcp", address
+
+	if i := strings.Index(address, "://"); i >= 0 {
+		network, addr = address[:i], address[i+3:]
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "unix":
+		// A socket left by a previous run would prevent from binding
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	default:
+		return nil, fmt.Errorf("Choose a correct listen address : tcp://host:port | unix:///path | host:port")
+	}
+
+	l, err := net.Listen(network, addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	defer l.Close()
+
+	switch l := l.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		return l.File()
+	}
+
+	return nil, fmt.Errorf("Can't hand over the %s listener", network)
+}
+
+// listenCommand wraps the command into the listen shim, the sockets being
+// passed from the fd 3 like systemd does.
+func (r *Runner) listenCommand(path string, envVariables map[string]string) (*exec.Cmd, map[string]string, error) {
+	self, err := os.Executable()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.Command(self, append([]string{listenShimArg, path}, r.Command...)...)
+	cmd.ExtraFiles = r.Listeners
+
+	env := map[string]string{"LISTEN_FDS": strconv.Itoa(len(r.Listeners))}
+
+	for k, v := range envVariables {
+		env[k] = v
+	}
+
+	return cmd, env, nil
+}
+
+// RunListenShim execs the command when etcdenv is invoked as the listen
+// shim of a process and never returns then, it returns right away
+// otherwise.
+func RunListenShim() {
+	if len(os.Args) < 4 || os.Args[1] != listenShimArg {
+		return
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	err := syscall.Exec(os.Args[2], os.Args[3:], os.Environ())
+
+	fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[3], err.Error())
+	os.Exit(ExitCannotExecute)
+}
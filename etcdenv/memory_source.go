@@ -0,0 +1,165 @@
+package etcdenv
+
+import (
+	"strings"
+	"sync"
+)
+
+// memorySourceHistory is the number of changes the memory source keeps at
+// least, like the event history of etcd v2.
+const memorySourceHistory = 1000
+
+// MemorySource is an in-memory Source, mostly useful to drive a context
+// without any etcd server. Every change bumps its index and is kept in an
+// history, trimmed to the last changes or dropped by Compact.
+type MemorySource struct {
+	mu      sync.Mutex
+	values  map[string]string
+	history []*Change
+	index   uint64
+	updated chan struct{}
+	closed  chan struct{}
+}
+
+func NewMemorySource() *MemorySource {
+	return &MemorySource{
+		values:  make(map[string]string),
+		updated: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Set stores the value of the absolute key and notifies the watchers of
+// its namespaces.
+func (s *MemorySource) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values[key] = value
+	s.record(&Change{Key: key, Value: value})
+}
+
+// Delete removes the absolute key and notifies the watchers of its
+// namespaces.
+func (s *MemorySource) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.values, key)
+	s.record(&Change{Key: key})
+}
+
+// Compact drops the history, the watchers lagging behind the current index
+// get an ErrIndexCleared error.
+func (s *MemorySource) Compact() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.history = nil
+}
+
+func (s *MemorySource) record(c *Change) {
+	s.index++
+	c.Index = s.index
+
+	s.history = append(s.history, c)
+
+	if len(s.history) >= 2*memorySourceHistory {
+		s.history = append([]*Change(nil), s.history[memorySourceHistory:]...)
+	}
+
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+func (s *MemorySource) Snapshot(namespace string) (map[string]string, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]string)
+
+	for key, value := range s.values {
+		if strings.HasPrefix(key, namespacePrefix(namespace)) {
+			result[key] = value
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, 0, newError(ErrKeyNotFound)
+	}
+
+	return result, s.index, nil
+}
+
+// pending returns the changes of the namespace following the index, the
+// current index and a channel closed on the next change.
+func (s *MemorySource) pending(namespace string, index uint64) ([]*Change, uint64, chan struct{}, error) {
+	var result []*Change
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index < s.index && (len(s.history) == 0 || s.history[0].Index > index+1) {
+		return nil, index, nil, newError(ErrIndexCleared)
+	}
+
+	for _, c := range s.history {
+		if c.Index > index && strings.HasPrefix(c.Key, namespacePrefix(namespace)) {
+			result = append(result, c)
+		}
+	}
+
+	return result, s.index, s.updated, nil
+}
+
+func (s *MemorySource) Watch(namespace string, index uint64, changes chan<- *Change, stop chan bool) (uint64, error) {
+	if index == 0 {
+		s.mu.Lock()
+		index = s.index
+		s.mu.Unlock()
+	}
+
+	for {
+		pending, current, updated, err := s.pending(namespace, index)
+
+		if err != nil {
+			return index, err
+		}
+
+		for _, c := range pending {
+			select {
+			case changes <- c:
+				index = c.Index
+			case <-stop:
+				return index, newError(ErrWatchStopped)
+			}
+		}
+
+		if len(pending) > 0 {
+			continue
+		}
+
+		index = current
+
+		select {
+		case <-updated:
+		case <-stop:
+			return index, newError(ErrWatchStopped)
+		case <-s.closed:
+			return index, newError(ErrWatchStopped)
+		}
+	}
+}
+
+func (s *MemorySource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package etcdenv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultProbeInterval         = 5 * time.Second
+	DefaultProbeTimeout          = time.Second
+	DefaultProbeFailureThreshold = 3
+)
+
+// Probe checks the health of a process. The target is either an HTTP URL
+// answering a GET with a 2xx or 3xx status, tcp://host:port accepting a
+// connection, or exec:command exiting with the status 0. It fails once
+// FailureThreshold checks failed in a row.
+type Probe struct {
+	Target           string
+	Interval         time.Duration
+	Timeout          time.Duration
+	FailureThreshold int
+}
+
+func DefaultProbe() Probe {
+	return Probe{
+		Interval:         DefaultProbeInterval,
+		Timeout:          DefaultProbeTimeout,
+		FailureThreshold: DefaultProbeFailureThreshold,
+	}
+}
+
+func (p Probe) Validate() error {
+	if !strings.HasPrefix(p.Target, "http://") && !strings.HasPrefix(p.Target, "https://") &&
+		!strings.HasPrefix(p.Target, "tcp://") && !strings.HasPrefix(p.Target, "exec:") {
+		return errors.New("Choose a correct probe : http://host:port/path | tcp://host:port | exec:command")
+	}
+
+	if p.Interval <= 0 || p.Timeout <= 0 || p.FailureThreshold <= 0 {
+		return errors.New("The probe interval, timeout and failure threshold must be positive")
+	}
+
+	return nil
+}
+
+// check runs the probe once, the exec probes get the environment of the
+// process and are run by the runner.
+func (p Probe) check(r *Runner, env []string) error {
+	switch {
+	case strings.HasPrefix(p.Target, "tcp://"):
+		conn, err := net.DialTimeout("tcp", strings.TrimPrefix(p.Target, "tcp://"), p.Timeout)
+
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	case strings.HasPrefix(p.Target, "exec:"):
+		ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", strings.TrimPrefix(p.Target, "exec:"))
+		cmd.Env = env
+
+		return r.runCommand(cmd)
+	}
+
+	client := http.Client{Timeout: p.Timeout}
+	resp, err := client.Get(p.Target)
+
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("%s answered %s", p.Target, resp.Status)
+	}
+
+	return nil
+}
+
+// run checks the process every interval, until the probe succeeds when
+// untilSuccess is set or until it fails. It returns nil once succeeded or
+// once the process exited.
+func (p Probe) run(r *Runner, env []string, exited <-chan struct{}, untilSuccess bool) error {
+	var failures int
+
+	for {
+		err := p.check(r, env)
+
+		if err == nil {
+			failures = 0
+
+			if untilSuccess {
+				return nil
+			}
+		} else if failures++; failures >= p.FailureThreshold {
+			return err
+		}
+
+		select {
+		case <-exited:
+			return nil
+		case <-time.After(p.Interval):
+		}
+	}
+}
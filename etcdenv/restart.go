@@ -0,0 +1,99 @@
+package etcdenv
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// ExitRestartLimit is the exit status of etcdenv once the process has
+// been restarted too many times.
+const ExitRestartLimit = 125
+
+// RestartConfig drives the restarts of a process which exited. The delay
+// between two restarts grows while the process keeps crashing and is reset
+// once it ran for HealthyUptime. At most MaxRestarts restarts are allowed
+// within Window, 0 meaning no limit.
+type RestartConfig struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	HealthyUptime   time.Duration
+	MaxRestarts     int
+	Window          time.Duration
+}
+
+func DefaultRestartConfig() RestartConfig {
+	return RestartConfig{
+		InitialInterval: time.Second,
+		MaxInterval:     time.Minute,
+		HealthyUptime:   30 * time.Second,
+		Window:          time.Minute,
+	}
+}
+
+func (c RestartConfig) Validate() error {
+	if c.InitialInterval <= 0 || c.MaxInterval < c.InitialInterval {
+		return errors.New("The restart intervals must be positive, the maximum one being greater than the initial one")
+	}
+
+	if c.HealthyUptime < 0 || c.MaxRestarts < 0 || c.Window < 0 {
+		return errors.New("The restart limits must be positive")
+	}
+
+	return nil
+}
+
+type restartTracker struct {
+	config   RestartConfig
+	b        *backoff.ExponentialBackOff
+	crashing bool
+	restarts []time.Time
+}
+
+func (c RestartConfig) tracker() *restartTracker {
+	b := backoff.NewExponentialBackOff()
+
+	b.InitialInterval = c.InitialInterval
+	b.MaxInterval = c.MaxInterval
+	b.MaxElapsedTime = 0
+	b.Reset()
+
+	return &restartTracker{config: c, b: b}
+}
+
+// next returns the delay before restarting a process which ran for the
+// given uptime, false once the restart limit is reached.
+func (t *restartTracker) next(uptime time.Duration, now time.Time) (time.Duration, bool) {
+	if t.config.MaxRestarts > 0 {
+		var restarts []time.Time
+
+		for _, r := range t.restarts {
+			if now.Sub(r) < t.config.Window {
+				restarts = append(restarts, r)
+			}
+		}
+
+		if len(restarts) >= t.config.MaxRestarts {
+			t.restarts = restarts
+			return 0, false
+		}
+
+		t.restarts = append(restarts, now)
+	}
+
+	if uptime >= t.config.HealthyUptime {
+		// The process was healthy, restart it right away
+		t.crashing = false
+		t.b.Reset()
+
+		return 0, true
+	}
+
+	if !t.crashing {
+		t.crashing = true
+		return 0, true
+	}
+
+	return t.b.NextBackOff(), true
+}
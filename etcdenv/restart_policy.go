@@ -0,0 +1,139 @@
+package etcdenv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RestartMode tells when a process which exited on its own is restarted,
+// following the systemd Restart= setting.
+type RestartMode string
+
+const (
+	RestartAlways     RestartMode = "always"
+	RestartOnSuccess  RestartMode = "on-success"
+	RestartOnFailure  RestartMode = "on-failure"
+	RestartOnAbnormal RestartMode = "on-abnormal"
+	// RestartNever makes etcdenv exit with the status of the process.
+	RestartNever RestartMode = "never"
+	// RestartKeepAlive never restarts the process on exit but keeps
+	// etcdenv alive, the process being started again on the next change.
+	RestartKeepAlive RestartMode = "keepalive"
+)
+
+// The shutdown behaviours of the previous versions
+var restartModeAliases = map[string]RestartMode{
+	"restart": RestartAlways,
+	"exit":    RestartNever,
+}
+
+func ParseRestartMode(value string) (RestartMode, error) {
+	if mode, ok := restartModeAliases[value]; ok {
+		return mode, nil
+	}
+
+	switch RestartMode(value) {
+	case RestartAlways, RestartOnSuccess, RestartOnFailure,
+		RestartOnAbnormal, RestartNever, RestartKeepAlive:
+		return RestartMode(value), nil
+	}
+
+	return "", fmt.Errorf(
+		"Choose a correct restart policy : %s | %s | %s | %s | %s | %s",
+		RestartAlways,
+		RestartOnSuccess,
+		RestartOnFailure,
+		RestartOnAbnormal,
+		RestartNever,
+		RestartKeepAlive,
+	)
+}
+
+// RestartPolicy decides whether a process which exited is restarted. The
+// status 0 and the SuccessExitStatuses are clean exits, the process is
+// never restarted when it exits with one of the PreventExitStatuses.
+type RestartPolicy struct {
+	Mode                RestartMode
+	SuccessExitStatuses []int
+	PreventExitStatuses []int
+}
+
+func (p RestartPolicy) Validate() error {
+	if _, err := ParseRestartMode(string(p.Mode)); err != nil {
+		return err
+	}
+
+	for _, statuses := range [][]int{p.SuccessExitStatuses, p.PreventExitStatuses} {
+		for _, status := range statuses {
+			if status < 0 || status > 255 {
+				return fmt.Errorf("Invalid exit status %d, it must be between 0 and 255", status)
+			}
+		}
+	}
+
+	return nil
+}
+
+// exits tells whether etcdenv exits along with the process when it is not
+// restarted.
+func (p RestartPolicy) exits() bool {
+	return p.Mode != RestartKeepAlive
+}
+
+func (p RestartPolicy) success(e *Event) bool {
+	return e.Type == EventExited && e.Signal == nil && e.Err == nil &&
+		(e.Status == 0 || containsInt(p.SuccessExitStatuses, e.Status))
+}
+
+func (p RestartPolicy) shouldRestart(e *Event) bool {
+	if e.Type == EventExited && e.Signal == nil && containsInt(p.PreventExitStatuses, e.Status) {
+		return false
+	}
+
+	switch p.Mode {
+	case RestartAlways:
+		return true
+	case RestartOnSuccess:
+		return p.success(e)
+	case RestartOnFailure:
+		return !p.success(e)
+	case RestartOnAbnormal:
+		// A process stopped by its liveness probe is abnormal whatever its
+		// exit status
+		return e.Signal != nil || e.Err != nil
+	}
+
+	return false
+}
+
+// ParseExitStatuses parses a comma-separated list of exit statuses.
+func ParseExitStatuses(value string) ([]int, error) {
+	var result []int
+
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		status, err := strconv.Atoi(s)
+
+		if err != nil || status < 0 || status > 255 {
+			return nil, fmt.Errorf("Invalid exit status %s, it must be between 0 and 255", s)
+		}
+
+		result = append(result, status)
+	}
+
+	return result, nil
+}
+
+func containsInt(values []int, item int) bool {
+	for _, v := range values {
+		if v == item {
+			return true
+		}
+	}
+
+	return false
+}
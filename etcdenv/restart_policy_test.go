@@ -0,0 +1,85 @@
+package etcdenv
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestParseRestartMode(t *testing.T) {
+	for value, expected := range map[string]RestartMode{
+		"always":      RestartAlways,
+		"on-abnormal": RestartOnAbnormal,
+		"keepalive":   RestartKeepAlive,
+		"restart":     RestartAlways,
+		"exit":        RestartNever,
+	} {
+		if mode, err := ParseRestartMode(value); err != nil || mode != expected {
+			t.Errorf("ParseRestartMode(%q) = %q, %v, expected %q", value, mode, err, expected)
+		}
+	}
+
+	if _, err := ParseRestartMode("sometimes"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+func TestNewContextNormalizesRestartMode(t *testing.T) {
+	ctx, err := NewContext(nil, NewMemorySource(), []string{"true"}, RestartPolicy{Mode: "restart"}, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ctx.RestartPolicy.Mode != RestartAlways {
+		t.Errorf("Expected the mode %q, got %q", RestartAlways, ctx.RestartPolicy.Mode)
+	}
+}
+
+func TestRestartPolicyShouldRestart(t *testing.T) {
+	var (
+		clean     = &Event{Type: EventExited}
+		failed    = &Event{Type: EventExited, Status: 1}
+		success   = &Event{Type: EventExited, Status: 42}
+		prevent   = &Event{Type: EventExited, Status: 3}
+		killed    = &Event{Type: EventExited, Status: 137, Signal: syscall.SIGKILL}
+		unhealthy = &Event{Type: EventExited, Err: errors.New("not alive")}
+		notFound  = &Event{Type: EventFailed, Status: ExitCommandNotFound}
+	)
+
+	for _, tt := range []struct {
+		mode     RestartMode
+		event    *Event
+		expected bool
+	}{
+		{RestartAlways, clean, true},
+		{RestartAlways, killed, true},
+		{RestartAlways, prevent, false},
+		{RestartOnSuccess, clean, true},
+		{RestartOnSuccess, success, true},
+		{RestartOnSuccess, failed, false},
+		{RestartOnSuccess, unhealthy, false},
+		{RestartOnFailure, clean, false},
+		{RestartOnFailure, success, false},
+		{RestartOnFailure, failed, true},
+		{RestartOnFailure, killed, true},
+		{RestartOnFailure, unhealthy, true},
+		{RestartOnFailure, notFound, true},
+		{RestartOnFailure, prevent, false},
+		{RestartOnAbnormal, failed, false},
+		{RestartOnAbnormal, killed, true},
+		{RestartOnAbnormal, unhealthy, true},
+		{RestartNever, killed, false},
+		{RestartKeepAlive, failed, false},
+	} {
+		policy := RestartPolicy{
+			Mode:                tt.mode,
+			SuccessExitStatuses: []int{42},
+			PreventExitStatuses: []int{3},
+		}
+
+		if restart := policy.shouldRestart(tt.event); restart != tt.expected {
+			t.Errorf("%s: shouldRestart(%+v) = %v, expected %v", tt.mode, *tt.event, restart, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package etcdenv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartTrackerBackoff(t *testing.T) {
+	config := DefaultRestartConfig()
+	tracker := config.tracker()
+	now := time.Now()
+
+	// The first crash is restarted right away, the next ones are delayed
+	if d, ok := tracker.next(time.Second, now); !ok || d != 0 {
+		t.Errorf("Expected an immediate restart, got %v, %v", d, ok)
+	}
+
+	for i := 0; i < 3; i++ {
+		if d, ok := tracker.next(time.Second, now); !ok || d <= 0 || d > config.MaxInterval {
+			t.Errorf("Expected a delayed restart, got %v, %v", d, ok)
+		}
+	}
+
+	// A healthy run resets the delays
+	if d, ok := tracker.next(config.HealthyUptime, now); !ok || d != 0 {
+		t.Errorf("Expected an immediate restart after a healthy run, got %v, %v", d, ok)
+	}
+
+	if d, ok := tracker.next(time.Second, now); !ok || d != 0 {
+		t.Errorf("Expected an immediate restart of the first crash, got %v, %v", d, ok)
+	}
+
+	// The randomized interval stays around the initial one
+	if d, _ := tracker.next(time.Second, now); d < config.InitialInterval/2 || d > 3*config.InitialInterval/2 {
+		t.Errorf("Expected a delay around %v, got %v", config.InitialInterval, d)
+	}
+}
+
+func TestRestartTrackerWindow(t *testing.T) {
+	config := DefaultRestartConfig()
+	config.MaxRestarts = 2
+	tracker := config.tracker()
+	now := time.Now()
+
+	for i, tt := range []struct {
+		at       time.Duration
+		expected bool
+	}{
+		{0, true},
+		{10 * time.Second, true},
+		{20 * time.Second, false},
+		{30 * time.Second, false},
+		// The first restart left the window
+		{61 * time.Second, true},
+		{65 * time.Second, false},
+		{71 * time.Second, true},
+	} {
+		if _, ok := tracker.next(config.HealthyUptime, now.Add(tt.at)); ok != tt.expected {
+			t.Errorf("Restart %d after %v: expected %v, got %v", i, tt.at, tt.expected, ok)
+		}
+	}
+}
+
+func TestContextRestartLimit(t *testing.T) {
+	source := NewMemorySource()
+	source.Set("/test/FOO", "bar")
+
+	ctx, err := NewContext([]string{"/test"}, source, []string{"/bin/sh", "-c", "exit 1"}, RestartPolicy{Mode: RestartAlways}, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.Restart.InitialInterval = 10 * time.Millisecond
+	ctx.Restart.MaxInterval = 10 * time.Millisecond
+	ctx.Restart.MaxRestarts = 2
+
+	status := make(chan int)
+
+	go func() { status <- ctx.Run() }()
+
+	select {
+	case s := <-status:
+		if s != ExitRestartLimit {
+			t.Errorf("Expected the status %d, got %d", ExitRestartLimit, s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The context never gave up")
+	}
+
+	if err := ctx.Runner.Stop(); !isError(err, ErrNotStarted) {
+		t.Errorf("Expected the runner to be stopped, got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package etcdenv
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/upfluence/goutils/log"
+)
+
+// fetchAllowedEnv fetches the environment from etcd, the current one being
+// kept as long as etcd still holds the environment which was rolled back.
+func (ctx *Context) fetchAllowedEnv() map[string]string {
+	env, _ := ctx.fetchEtcdVariables()
+
+	if ctx.blockedEnv == nil {
+		return env
+	}
+
+	if changedKeys(env, ctx.blockedEnv) == nil {
+		log.Warning("The faulty environment is still in etcd, keeping the current one")
+		return ctx.CurrentEnv
+	}
+
+	// etcd changed again, the new environment gets its chance
+	ctx.blockedEnv = nil
+
+	return env
+}
+
+// changeEnv restarts the process with the environment changed in etcd, the
+// new process is on probation until it ran healthily for the rollback
+// window.
+func (ctx *Context) changeEnv(env map[string]string) {
+	ctx.CurrentEnv = env
+	ctx.restart()
+
+	if ctx.RollbackWindow > 0 {
+		ctx.probation = ctx.Runner.LastGeneration()
+	}
+}
+
+// markHealthy remembers the environment of the process which ran healthily
+// for the rollback window.
+func (ctx *Context) markHealthy(generation uint64) {
+	if generation != ctx.Runner.Generation() {
+		return
+	}
+
+	if ctx.probation == generation {
+		log.Noticef("Child process healthy with the new environment, generation %d", generation)
+		ctx.probation = 0
+	}
+
+	ctx.lastGoodEnv = ctx.CurrentEnv
+}
+
+// rollback restarts the process with the last known good environment when
+// the failing process was started with a new one, the faulty environment
+// is blocked until etcd changes again.
+func (ctx *Context) rollback(e *Event) bool {
+	if ctx.RollbackWindow <= 0 || ctx.probation != e.Generation || ctx.lastGoodEnv == nil {
+		return false
+	}
+
+	log.Errorf(
+		"The change of %s broke the child process, rolling back to the last known good environment",
+		strings.Join(changedKeys(ctx.lastGoodEnv, ctx.CurrentEnv), ", "),
+	)
+
+	ctx.blockedEnv = ctx.CurrentEnv
+	ctx.probation = 0
+	ctx.CurrentEnv = ctx.lastGoodEnv
+	ctx.restart()
+
+	return true
+}
+
+// discard puts back the environment of the generation kept running when
+// the last one is discarded, without restarting it. A new environment on
+// probation is blocked like on a rollback.
+func (ctx *Context) discard(e *Event) {
+	env, ok := ctx.envs[ctx.Runner.Generation()]
+
+	if !ok || e.Generation != ctx.Runner.LastGeneration() {
+		return
+	}
+
+	if ctx.RollbackWindow > 0 && ctx.probation == e.Generation {
+		log.Errorf(
+			"The change of %s broke the child process, keeping the previous generation",
+			strings.Join(changedKeys(env, ctx.CurrentEnv), ", "),
+		)
+
+		ctx.blockedEnv = ctx.CurrentEnv
+		ctx.probation = 0
+	}
+
+	ctx.CurrentEnv = env
+}
+
+// changedKeys returns the sorted keys whose values differ between the two
+// environments.
+func changedKeys(a, b map[string]string) []string {
+	var keys []string
+
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			keys = append(keys, k)
+		}
+	}
+
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,64 @@
+package etcdenv
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChangedKeys(t *testing.T) {
+	keys := changedKeys(
+		map[string]string{"A": "1", "B": "2", "C": "3"},
+		map[string]string{"A": "1", "B": "4", "D": "5"},
+	)
+
+	if expected := []string{"B", "C", "D"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected the keys %v, got %v", expected, keys)
+	}
+}
+
+func TestContextRollback(t *testing.T) {
+	source := NewMemorySource()
+	source.Set("/test/FOO", "bar")
+
+	output, stop := runContext(t, source, "FOO", func(ctx *Context) {
+		ctx.RollbackWindow = 100 * time.Millisecond
+	})
+	defer stop()
+
+	waitOutput(t, output, "bar")
+
+	// Let the first generation run healthily for the rollback window
+	time.Sleep(300 * time.Millisecond)
+
+	source.Set("/test/FOO", "crash")
+	waitOutput(t, output, "bar", "crash", "bar")
+
+	// The faulty environment stays blocked until etcd changes again
+	source.Set("/test/FOO", "crash")
+	time.Sleep(300 * time.Millisecond)
+	waitOutput(t, output, "bar", "crash", "bar")
+
+	source.Set("/test/FOO", "baz")
+	waitOutput(t, output, "bar", "crash", "bar", "baz")
+}
+
+func TestContextNoRollbackBeforeHealthy(t *testing.T) {
+	source := NewMemorySource()
+	source.Set("/test/FOO", "bar")
+
+	output, stop := runContext(t, source, "FOO", func(ctx *Context) {
+		ctx.RollbackWindow = time.Minute
+		// Only the first crash is restarted during the test
+		ctx.Restart.InitialInterval = time.Minute
+		ctx.Restart.MaxInterval = time.Minute
+	})
+	defer stop()
+
+	waitOutput(t, output, "bar")
+
+	// No known good environment yet, the crashing process is restarted
+	// with the environment of etcd
+	source.Set("/test/FOO", "crash")
+	waitOutput(t, output, "bar", "crash", "crash")
+}
@@ -1,103 +1,666 @@
 package etcdenv
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/upfluence/goutils/log"
+)
+
+const (
+	DefaultStopSignal  = syscall.SIGTERM
+	DefaultStopTimeout = 10 * time.Second
+
+	// Exit statuses of the processes which can't be started, following the
+	// shell convention
+	ExitCommandNotFound = 127
+	ExitCannotExecute   = 126
+
+	// killTimeout bounds the wait for a killed process group to vanish
+	killTimeout = 5 * time.Second
 )
 
 type Runner struct {
-	Command      []string
-	DefaultEnv   []string
-	IsRestarting bool
+	Command    []string
+	DefaultEnv []string
+	// StopSignal is sent to the process to stop it, it is killed if it
+	// is still running after StopTimeout.
+	StopSignal  syscall.Signal
+	StopTimeout time.Duration
+	// NewSession starts the process in its own session instead of its own
+	// process group, detaching it from the controlling terminal.
+	NewSession bool
+	// Overlap starts the new process before stopping the old one on
+	// restart, the old one being stopped once the new one is ready.
+	Overlap bool
+	// ReadyDelay is the time after which a started process is ready.
+	ReadyDelay time.Duration
+	// ReadinessProbe tells when a started process is ready, once
+	// ReadyDelay is elapsed. A process which never gets ready is stopped.
+	ReadinessProbe *Probe
+	// LivenessProbe checks a ready process, it is stopped once the probe
+	// fails and its exit is handled like any other.
+	LivenessProbe *Probe
+	// Listeners are the sockets handed over to every process, from the fd
+	// 3 along with the LISTEN_FDS and LISTEN_PID variables.
+	Listeners []*os.File
+
+	requests   chan *runnerRequest
+	exits      chan *process
+	readies    chan *process
+	failures   chan *processFailure
+	events     chan *Event
+	lastStatus int32
 
-	cmd *exec.Cmd
+	// generation counts the processes spawned, kept is the generation of
+	// the process the runner keeps running
+	generation uint64
+	kept       uint64
+
+	// foreground tells the processes take over the terminal etcdenv was
+	// started in the foreground of
+	foregroundOnce sync.Once
+	foreground     bool
+
+	// pids are the processes waited by the runner, which must not be
+	// reaped by the init mode
+	pidsMu sync.Mutex
+	pids   map[int]bool
+}
+
+type runnerAction int
+
+const (
+	runnerStart runnerAction = iota
+	runnerStop
+	runnerRestart
+	runnerSignal
+)
+
+type runnerRequest struct {
+	action runnerAction
+	env    map[string]string
+	signal os.Signal
+	reply  chan error
+}
+
+// process is a child instance, its status is available once the exited
+// channel is closed.
+type process struct {
+	generation uint64
+	cmd        *exec.Cmd
+	exited     chan struct{}
+	status     int
+	signal     os.Signal
+}
+
+// processFailure is a process failing its probes.
+type processFailure struct {
+	process *process
+	err     error
 }
 
 func NewRunner(command []string) *Runner {
-	return &Runner{
-		Command:    command,
-		DefaultEnv: os.Environ(),
+	r := &Runner{
+		Command:     command,
+		DefaultEnv:  os.Environ(),
+		StopSignal:  DefaultStopSignal,
+		StopTimeout: DefaultStopTimeout,
+		requests:    make(chan *runnerRequest),
+		exits:       make(chan *process),
+		readies:     make(chan *process),
+		failures:    make(chan *processFailure),
+		events:      make(chan *Event),
+		pids:        make(map[int]bool),
 	}
+
+	go r.loop()
+
+	return r
 }
 
+// buildEnvs overrides the default environment with the given variables,
+// each variable being set once as execve doesn't pick the last value.
 func (r *Runner) buildEnvs(envVariables map[string]string) []string {
-	envs := r.DefaultEnv
+	var envs []string
+
+	for _, env := range r.DefaultEnv {
+		if _, ok := envVariables[strings.SplitN(env, "=", 2)[0]]; !ok {
+			envs = append(envs, env)
+		}
+	}
+
+	keys := make([]string, 0, len(envVariables))
 
-	for k, v := range envVariables {
-		envs = append(envs, fmt.Sprintf("%s=%s", k, v))
+	for k := range envVariables {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		envs = append(envs, fmt.Sprintf("%s=%s", k, envVariables[k]))
 	}
 
 	return envs
 }
 
-func (r *Runner) Start(envVariables map[string]string) error {
-	if r.cmd != nil && r.cmd.Process != nil {
-		return newError(ErrAlreadyStarted)
-	}
+// Events returns the lifecycle events of the child instances, in the
+// order they happened.
+func (r *Runner) Events() <-chan *Event {
+	return r.events
+}
 
-	r.cmd = exec.Command(r.Command[0], r.Command[1:]...)
+// Generation returns the generation of the process kept running, with
+// the overlap a new generation only replaces the previous one once ready.
+func (r *Runner) Generation() uint64 {
+	return atomic.LoadUint64(&r.kept)
+}
 
-	r.cmd.Env = r.buildEnvs(envVariables)
-	r.cmd.Stdout = os.Stdout
-	r.cmd.Stderr = os.Stderr
-	r.cmd.Stdin = os.Stdin
+// LastGeneration returns the generation of the last spawned process.
+func (r *Runner) LastGeneration() uint64 {
+	return atomic.LoadUint64(&r.generation)
+}
 
-	r.cmd.Start()
+// LastExitStatus returns the exit status of the last process which exited.
+func (r *Runner) LastExitStatus() int {
+	return int(atomic.LoadInt32(&r.lastStatus))
+}
 
-	return nil
+func (r *Runner) Start(envVariables map[string]string) error {
+	return r.request(&runnerRequest{action: runnerStart, env: envVariables})
 }
 
 func (r *Runner) Stop() error {
-	if r.cmd == nil || r.cmd.Process == nil {
-		return newError(ErrNotStarted)
+	return r.request(&runnerRequest{action: runnerStop})
+}
+
+// Restart stops the running process, if any, and starts a new one.
+func (r *Runner) Restart(envVariables map[string]string) error {
+	return r.request(&runnerRequest{action: runnerRestart, env: envVariables})
+}
+
+// Signal sends the signal to the running process, and to the one it
+// replaces until it is ready.
+func (r *Runner) Signal(sig os.Signal) error {
+	return r.request(&runnerRequest{action: runnerSignal, signal: sig})
+}
+
+func (r *Runner) request(req *runnerRequest) error {
+	req.reply = make(chan error, 1)
+	r.requests <- req
+
+	return <-req.reply
+}
+
+// loop is the only one touching the processes, the requests and the exits
+// are handled one at a time. The events are queued so the loop never
+// waits for them to be consumed.
+func (r *Runner) loop() {
+	var (
+		// retiring is the process replaced by the current one, kept running
+		// until the current one is ready
+		current, retiring *process
+		pending           []*Event
+	)
+
+	emit := func(e *Event) { pending = append(pending, e) }
+
+	keep := func(generation uint64) { atomic.StoreUint64(&r.kept, generation) }
+
+	// lost is called once the current process is gone, the retiring one
+	// keeps running when the current one never got ready. The event of the
+	// lost process is marked as discarded then.
+	lost := func(e *Event) {
+		current = nil
+
+		if retiring == nil {
+			return
+		}
+
+		log.Warningf(
+			"Generation %d exited before being ready, generation %d keeps running",
+			e.Generation,
+			retiring.generation,
+		)
+
+		current, retiring = retiring, nil
+		keep(current.generation)
+		e.Discarded = true
+	}
+
+	start := func(env map[string]string, t EventType) error {
+		p, err := r.spawn(env)
+
+		if err != nil {
+			e := r.failure(err)
+			keep(e.Generation)
+			lost(e)
+			emit(e)
+
+			return err
+		}
+
+		current = p
+		keep(p.generation)
+		emit(&Event{Type: t, Generation: p.generation, Pid: p.cmd.Process.Pid})
+
+		return nil
 	}
 
-	r.cmd.Process.Kill()
-	r.cmd.Process.Wait()
+	for {
+		var (
+			events chan *Event
+			next   *Event
+		)
+
+		if len(pending) > 0 {
+			events, next = r.events, pending[0]
+		}
+
+		select {
+		case events <- next:
+			pending = pending[1:]
+		case p := <-r.exits:
+			e := &Event{
+				Type:       EventExited,
+				Generation: p.generation,
+				Pid:        p.cmd.Process.Pid,
+				Status:     p.status,
+				Signal:     p.signal,
+			}
+
+			switch p {
+			case retiring:
+				retiring = nil
+			case current:
+				lost(e)
+			default:
+				// Already reported by the stop
+				continue
+			}
+
+			emit(e)
+		case f := <-r.failures:
+			p := f.process
+
+			if p != current || p.hasExited() {
+				continue
+			}
+
+			log.Warningf("Generation %d failed its probe, stopping it: %s", p.generation, f.err.Error())
+			emit(&Event{Type: EventUnhealthy, Generation: p.generation, Pid: p.cmd.Process.Pid, Err: f.err})
+
+			// The process didn't exit on purpose, its exit is handled like
+			// a crash
+			e := r.stop(p)
+			e.Stopped = false
+			e.Err = f.err
+			lost(e)
+			emit(e)
+		case p := <-r.readies:
+			if p != current || p.hasExited() {
+				continue
+			}
+
+			emit(&Event{Type: EventReady, Generation: p.generation, Pid: p.cmd.Process.Pid})
+
+			if retiring != nil {
+				emit(r.stop(retiring))
+				retiring = nil
+			}
+		case req := <-r.requests:
+			var err error
+
+			switch req.action {
+			case runnerStart:
+				if current != nil {
+					err = newError(ErrAlreadyStarted)
+					break
+				}
+
+				err = start(req.env, EventStarted)
+			case runnerStop:
+				if current == nil {
+					err = newError(ErrNotStarted)
+					break
+				}
+
+				if retiring != nil {
+					emit(r.stop(retiring))
+					retiring = nil
+				}
+
+				emit(r.stop(current))
+				current = nil
+			case runnerRestart:
+				if current != nil && r.Overlap {
+					if retiring == nil {
+						retiring = current
+					} else {
+						// The current process never got ready, the retiring
+						// one is still the one to keep running
+						emit(r.stop(current))
+					}
+
+					current = nil
+					err = start(req.env, EventRestarted)
 
-	r.cmd = nil
+					break
+				}
+
+				if retiring != nil {
+					emit(r.stop(retiring))
+					retiring = nil
+				}
+
+				if current != nil {
+					emit(r.stop(current))
+					current = nil
+				}
+
+				err = start(req.env, EventRestarted)
+			case runnerSignal:
+				if current == nil {
+					err = newError(ErrNotStarted)
+					break
+				}
+
+				// The retiring process keeps serving until the current one
+				// is ready, it gets the signal as well
+				if retiring != nil {
+					retiring.cmd.Process.Signal(req.signal)
+				}
+
+				err = current.cmd.Process.Signal(req.signal)
+			}
 
-	return nil
+			req.reply <- err
+		}
+	}
 }
 
-func (r *Runner) Restart(envVariables map[string]string) error {
-	r.IsRestarting = true
-	defer func() { r.IsRestarting = false }()
+// spawn starts a new generation of the process, a generation is consumed
+// even if the process can't be started.
+func (r *Runner) spawn(envVariables map[string]string) (*process, error) {
+	generation := atomic.AddUint64(&r.generation, 1)
+	cmd := exec.Command(r.Command[0], r.Command[1:]...)
+
+	if cmd.Err != nil {
+		return nil, startError(r.Command[0], cmd.Err)
+	}
+
+	if len(r.Listeners) > 0 {
+		path, err := exec.LookPath(r.Command[0])
+
+		if err != nil {
+			return nil, startError(r.Command[0], err)
+		}
+
+		if cmd, envVariables, err = r.listenCommand(path, envVariables); err != nil {
+			return nil, startError(r.Command[0], err)
+		}
+	}
+
+	cmd.Env = r.buildEnvs(envVariables)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+
+	// The process leads its own group so it can be stopped along with its
+	// own children. That group must be the foreground one of the terminal
+	// for the process to read it.
+	r.foregroundOnce.Do(func() { r.foreground = terminalForeground() })
+
+	if r.NewSession {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	} else {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Foreground: r.foreground}
+	}
+
+	r.pidsMu.Lock()
+	defer r.pidsMu.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return nil, startError(r.Command[0], err)
+	}
+
+	r.pids[cmd.Process.Pid] = true
+
+	p := &process{
+		generation: generation,
+		cmd:        cmd,
+		exited:     make(chan struct{}),
+	}
+
+	go r.reap(p)
+	go r.awaitReady(p)
+
+	return p, nil
+}
 
-	r.Stop()
+// owns tells whether the process is waited by the runner.
+func (r *Runner) owns(pid int) bool {
+	r.pidsMu.Lock()
+	defer r.pidsMu.Unlock()
 
-	return r.Start(envVariables)
+	return r.pids[pid]
 }
 
-func (r *Runner) Wait() error {
-	if r.cmd == nil || r.cmd.Process == nil {
-		return newError(ErrNotStarted)
+// runCommand runs a command of etcdenv besides the process, registered
+// like the processes so that the init mode doesn't reap it before Wait.
+func (r *Runner) runCommand(cmd *exec.Cmd) error {
+	r.pidsMu.Lock()
+
+	if err := cmd.Start(); err != nil {
+		r.pidsMu.Unlock()
+		return err
 	}
 
-	err := r.cmd.Wait()
+	r.pids[cmd.Process.Pid] = true
+	r.pidsMu.Unlock()
+
+	err := cmd.Wait()
+
+	r.pidsMu.Lock()
+	delete(r.pids, cmd.Process.Pid)
+	r.pidsMu.Unlock()
 
 	return err
 }
 
-func (r *Runner) WatchProcess(exitStatus chan int) {
-	for {
-		time.Sleep(200 * time.Millisecond)
-		err := r.Wait()
-
-		if !r.IsRestarting {
-			if exiterr, ok := err.(*exec.ExitError); ok {
-				if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-					exitStatus <- status.ExitStatus()
-				} else {
-					exitStatus <- 0
-				}
-			} else {
-				exitStatus <- 0
-			}
-			break
+// startError tells a missing command apart from a command which can't be
+// executed.
+func startError(command string, err error) *EtcdenvError {
+	if errors.Is(err, exec.ErrNotFound) {
+		return &EtcdenvError{
+			ErrorCode: ErrCommandNotFound,
+			Message: fmt.Sprintf(
+				"%s: %s in PATH %s",
+				command,
+				errorMap[ErrCommandNotFound],
+				os.Getenv("PATH"),
+			),
+		}
+	}
+
+	if errors.Is(err, os.ErrNotExist) {
+		return &EtcdenvError{
+			ErrorCode: ErrCommandNotFound,
+			Message:   fmt.Sprintf("%s: %s", command, errorMap[ErrCommandNotFound]),
 		}
 	}
+
+	return &EtcdenvError{
+		ErrorCode: ErrStartFailed,
+		Message:   fmt.Sprintf("%s: %s: %s", command, errorMap[ErrStartFailed], err.Error()),
+	}
+}
+
+// failure returns the event of a process which couldn't be started.
+func (r *Runner) failure(err error) *Event {
+	status := ExitCannotExecute
+
+	if isError(err, ErrCommandNotFound) {
+		status = ExitCommandNotFound
+	}
+
+	atomic.StoreInt32(&r.lastStatus, int32(status))
+
+	return &Event{
+		Type:       EventFailed,
+		Generation: r.LastGeneration(),
+		Status:     status,
+		Err:        err,
+	}
+}
+
+// reap is the only one waiting for the process, the loop is notified once
+// its status is known.
+func (r *Runner) reap(p *process) {
+	p.cmd.Wait()
+
+	r.pidsMu.Lock()
+	delete(r.pids, p.cmd.Process.Pid)
+	r.pidsMu.Unlock()
+
+	if p.cmd.ProcessState != nil {
+		p.status = exitStatus(p.cmd.ProcessState)
+
+		if ws, ok := p.cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			p.signal = ws.Signal()
+		}
+	}
+
+	atomic.StoreInt32(&r.lastStatus, int32(p.status))
+	close(p.exited)
+
+	r.exits <- p
+}
+
+func (p *process) hasExited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// awaitReady notifies the loop once the process is ready, then checks its
+// liveness. Nothing is notified once the process exited.
+func (r *Runner) awaitReady(p *process) {
+	select {
+	case <-time.After(r.ReadyDelay):
+	case <-p.exited:
+		return
+	}
+
+	if r.ReadinessProbe != nil {
+		if err := r.ReadinessProbe.run(r, p.cmd.Env, p.exited, true); err != nil {
+			r.failures <- &processFailure{process: p, err: fmt.Errorf("not ready: %s", err.Error())}
+			return
+		}
+
+		if p.hasExited() {
+			return
+		}
+	}
+
+	r.readies <- p
+
+	if r.LivenessProbe == nil {
+		return
+	}
+
+	if err := r.LivenessProbe.run(r, p.cmd.Env, p.exited, false); err != nil && !p.hasExited() {
+		r.failures <- &processFailure{process: p, err: fmt.Errorf("not alive: %s", err.Error())}
+	}
+}
+
+// stop stops the process along with its group, it returns the exit event
+// of the process.
+func (r *Runner) stop(p *process) *Event {
+	pgid := p.cmd.Process.Pid
+	deadline := time.After(r.StopTimeout)
+
+	syscall.Kill(-pgid, r.StopSignal)
+	// A stopped process only handles the stop signal once continued
+	syscall.Kill(-pgid, syscall.SIGCONT)
+
+	select {
+	case <-p.exited:
+	case <-deadline:
+		log.Warningf("Process still running after %v, killing it", r.StopTimeout)
+		syscall.Kill(-pgid, syscall.SIGKILL)
+		<-p.exited
+		deadline = nil
+	}
+
+	waitProcessGroup(pgid, deadline, deadline == nil)
+
+	return &Event{
+		Type:       EventExited,
+		Generation: p.generation,
+		Pid:        pgid,
+		Status:     p.status,
+		Signal:     p.signal,
+		Stopped:    true,
+	}
+}
+
+// waitProcessGroup waits for every member of the process group to exit,
+// the remaining ones being killed once the deadline is reached. Once the
+// group got killed, the wait is bounded by killTimeout: a process stuck in
+// the kernel can't be helped.
+func waitProcessGroup(pgid int, deadline <-chan time.Time, killed bool) {
+	var giveUp <-chan time.Time
+
+	if killed {
+		giveUp = time.After(killTimeout)
+	}
+
+	for groupAlive(pgid) {
+		select {
+		case <-deadline:
+			log.Warningf("Process group %d still running, killing it", pgid)
+			syscall.Kill(-pgid, syscall.SIGKILL)
+			deadline = nil
+			giveUp = time.After(killTimeout)
+		case <-giveUp:
+			log.Errorf("Process group %d still running after being killed, giving up", pgid)
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// exitStatus follows the shell convention, a process killed by a signal
+// exits with 128 + the signal number.
+func exitStatus(state *os.ProcessState) int {
+	status, ok := state.Sys().(syscall.WaitStatus)
+
+	if !ok {
+		return state.ExitCode()
+	}
+
+	if status.Signaled() {
+		if status.CoreDump() {
+			log.Errorf("Child process killed by signal %s (core dumped)", status.Signal())
+		} else {
+			log.Noticef("Child process killed by signal %s", status.Signal())
+		}
+
+		return 128 + int(status.Signal())
+	}
+
+	return status.ExitStatus()
 }
@@ -0,0 +1,406 @@
+package etcdenv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event of the runner, failing the test when
+// nothing happens.
+func nextEvent(t *testing.T, r *Runner) *Event {
+	t.Helper()
+
+	select {
+	case e := <-r.Events():
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event emitted by the runner")
+	}
+
+	return nil
+}
+
+// expectEvent checks the type and generation of the next event.
+func expectEvent(t *testing.T, r *Runner, typ EventType, generation uint64) *Event {
+	t.Helper()
+
+	e := nextEvent(t, r)
+
+	if e.Type != typ || e.Generation != generation {
+		t.Fatalf("Expected %s of generation %d, got %s of generation %d", typ, generation, e.Type, e.Generation)
+	}
+
+	return e
+}
+
+func TestRunnerGenerations(t *testing.T) {
+	r := NewRunner([]string{"sleep", "60"})
+
+	if err := r.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Start(nil); !isError(err, ErrAlreadyStarted) {
+		t.Errorf("Expected an already started error, got %v", err)
+	}
+
+	expectEvent(t, r, EventStarted, 1)
+	expectEvent(t, r, EventReady, 1)
+
+	for generation := uint64(2); generation <= 3; generation++ {
+		if err := r.Restart(nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if e := expectEvent(t, r, EventExited, generation-1); !e.Stopped {
+			t.Errorf("Expected the exit of generation %d to be a stop", e.Generation)
+		}
+
+		expectEvent(t, r, EventRestarted, generation)
+		expectEvent(t, r, EventReady, generation)
+	}
+
+	if g := r.Generation(); g != 3 {
+		t.Errorf("Expected the generation 3, got %d", g)
+	}
+
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := expectEvent(t, r, EventExited, 3); !e.Stopped || e.Signal != syscall.SIGTERM {
+		t.Errorf("Expected generation 3 to be stopped by SIGTERM, got %+v", e)
+	}
+
+	if err := r.Stop(); !isError(err, ErrNotStarted) {
+		t.Errorf("Expected a not started error, got %v", err)
+	}
+}
+
+func TestRunnerExit(t *testing.T) {
+	r := NewRunner([]string{"/bin/sh", "-c", "exit 3"})
+
+	if err := r.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvent(t, r, EventStarted, 1)
+
+	// The readiness races with the exit, only the exit matters
+	e := nextEvent(t, r)
+
+	if e.Type == EventReady {
+		e = nextEvent(t, r)
+	}
+
+	if e.Type != EventExited || e.Stopped || e.Status != 3 || e.Signal != nil {
+		t.Errorf("Expected an exit with the status 3, got %+v", e)
+	}
+
+	if s := r.LastExitStatus(); s != 3 {
+		t.Errorf("Expected the last exit status 3, got %d", s)
+	}
+}
+
+func TestRunnerStartFailure(t *testing.T) {
+	r := NewRunner([]string{"etcdenv-command-not-found"})
+
+	if err := r.Start(nil); !isError(err, ErrCommandNotFound) {
+		t.Errorf("Expected a command not found error, got %v", err)
+	}
+
+	if e := expectEvent(t, r, EventFailed, 1); e.Status != ExitCommandNotFound || e.Err == nil {
+		t.Errorf("Expected a failure with the status %d, got %+v", ExitCommandNotFound, e)
+	}
+}
+
+func TestRunnerOverlapDiscarded(t *testing.T) {
+	r := NewRunner([]string{"/bin/sh", "-c", `test "$MODE" = crash && exit 1; exec sleep 60`})
+	r.Overlap = true
+	r.ReadinessProbe = &Probe{
+		Target:           `exec:test "$MODE" = ok`,
+		Interval:         50 * time.Millisecond,
+		Timeout:          time.Second,
+		FailureThreshold: 100,
+	}
+
+	if err := r.Start(map[string]string{"MODE": "ok"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvent(t, r, EventStarted, 1)
+	expectEvent(t, r, EventReady, 1)
+
+	if err := r.Restart(map[string]string{"MODE": "crash"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvent(t, r, EventRestarted, 2)
+
+	if e := expectEvent(t, r, EventExited, 2); !e.Discarded || e.Status != 1 {
+		t.Errorf("Expected generation 2 to be discarded, got %+v", e)
+	}
+
+	if g := r.Generation(); g != 1 {
+		t.Errorf("Expected generation 1 to keep running, got %d", g)
+	}
+
+	if g := r.LastGeneration(); g != 2 {
+		t.Errorf("Expected the last generation 2, got %d", g)
+	}
+
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvent(t, r, EventExited, 1)
+}
+
+func TestRunnerOverlapSignal(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output")
+
+	r := NewRunner([]string{
+		"/bin/sh",
+		"-c",
+		fmt.Sprintf(`trap "echo $MODE >> %[1]s" USR1; touch %[1]s.$MODE; while :; do sleep 0.05; done`, output),
+	})
+	r.Overlap = true
+	r.ReadinessProbe = &Probe{
+		Target:           fmt.Sprintf(`exec:test "$MODE" = ok && test -e %s.ok`, output),
+		Interval:         50 * time.Millisecond,
+		Timeout:          time.Second,
+		FailureThreshold: 1000,
+	}
+
+	if err := r.Start(map[string]string{"MODE": "ok"}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Stop()
+
+	expectEvent(t, r, EventStarted, 1)
+	expectEvent(t, r, EventReady, 1)
+
+	// The new generation never gets ready, the first one keeps serving
+	if err := r.Restart(map[string]string{"MODE": "slow"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvent(t, r, EventRestarted, 2)
+	waitFile(t, output+".slow")
+
+	if err := r.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		content, _ := ioutil.ReadFile(output)
+		lines := strings.Fields(string(content))
+		sort.Strings(lines)
+
+		if strings.Join(lines, " ") == "ok slow" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected both generations to get the signal, got %q", content)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunnerConcurrentRequests(t *testing.T) {
+	r := NewRunner([]string{"sleep", "60"})
+	r.StopTimeout = time.Second
+
+	var (
+		wg     sync.WaitGroup
+		events []*Event
+		done   = make(chan struct{})
+	)
+
+	go func() {
+		defer close(done)
+
+		for {
+			select {
+			case e := <-r.Events():
+				events = append(events, e)
+			case <-time.After(time.Second):
+				return
+			}
+		}
+	}()
+
+	if err := r.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 5; j++ {
+				r.Restart(nil)
+				r.Signal(syscall.SIGCONT)
+				r.Stop()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if err := r.Restart(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	<-done
+
+	var (
+		last    uint64
+		running = make(map[uint64]bool)
+	)
+
+	for _, e := range events {
+		switch e.Type {
+		case EventStarted, EventRestarted:
+			if e.Generation <= last {
+				t.Errorf("Generation %d started after generation %d", e.Generation, last)
+			}
+
+			last = e.Generation
+			running[e.Generation] = true
+		case EventReady:
+			if !running[e.Generation] {
+				t.Errorf("Generation %d ready while not running", e.Generation)
+			}
+		case EventExited:
+			if !running[e.Generation] {
+				t.Errorf("Generation %d exited while not running", e.Generation)
+			}
+
+			delete(running, e.Generation)
+		default:
+			t.Errorf("Unexpected %s event of generation %d", e.Type, e.Generation)
+		}
+	}
+
+	if len(running) > 0 {
+		t.Errorf("Generations %v never exited", running)
+	}
+
+	if g := r.Generation(); g != last {
+		t.Errorf("Expected the generation %d, got %d", last, g)
+	}
+}
+
+// startTrapped starts a command once its traps are set, the command
+// touches the marker file when done.
+func startTrapped(t *testing.T, script string) *Runner {
+	marker := filepath.Join(t.TempDir(), "marker")
+
+	r := NewRunner([]string{"/bin/sh", "-c", fmt.Sprintf(script, marker)})
+	r.StopTimeout = 500 * time.Millisecond
+
+	if err := r.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFile(t, marker)
+
+	return r
+}
+
+// waitFile waits until the command created the file.
+func waitFile(t *testing.T, path string) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("The command never created %s", path)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stopEvent stops the runner and returns the exit event along with the
+// duration of the stop.
+func stopEvent(t *testing.T, r *Runner) (*Event, time.Duration) {
+	t.Helper()
+
+	expectEvent(t, r, EventStarted, 1)
+	startedAt := time.Now()
+
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	elapsed := time.Since(startedAt)
+
+	for {
+		if e := nextEvent(t, r); e.Type == EventExited {
+			return e, elapsed
+		}
+	}
+}
+
+func TestRunnerStopKillsAfterTimeout(t *testing.T) {
+	r := startTrapped(t, `trap "" TERM; touch %s; exec sleep 60`)
+	e, elapsed := stopEvent(t, r)
+
+	if elapsed < r.StopTimeout {
+		t.Errorf("The process got killed after %v, before the stop timeout", elapsed)
+	}
+
+	if !e.Stopped || e.Signal != syscall.SIGKILL || e.Status != 128+int(syscall.SIGKILL) {
+		t.Errorf("Expected the process to be killed, got %+v", e)
+	}
+}
+
+func TestRunnerStopCleanExit(t *testing.T) {
+	r := startTrapped(t, `trap "exit 0" TERM; touch %s; while :; do sleep 0.05; done`)
+	r.StopTimeout = 5 * time.Second
+	e, elapsed := stopEvent(t, r)
+
+	if elapsed >= r.StopTimeout {
+		t.Errorf("The process exited after %v, not within the stop timeout", elapsed)
+	}
+
+	if !e.Stopped || e.Signal != nil || e.Status != 0 {
+		t.Errorf("Expected a clean exit, got %+v", e)
+	}
+}
+
+func TestRunnerStopKillsProcessGroup(t *testing.T) {
+	// The process exits on the stop signal while its child traps it
+	r := startTrapped(t, `(trap "" TERM; exec sleep 60) & touch %s; wait`)
+	e, elapsed := stopEvent(t, r)
+
+	if elapsed < r.StopTimeout || elapsed >= r.StopTimeout+killTimeout {
+		t.Errorf("The process group got killed after %v", elapsed)
+	}
+
+	if !e.Stopped || e.Signal != syscall.SIGTERM {
+		t.Errorf("Expected the process to exit on the stop signal, got %+v", e)
+	}
+}
@@ -0,0 +1,69 @@
+package etcdenv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var signalNames = map[string]syscall.Signal{
+	"ABRT":   syscall.SIGABRT,
+	"ALRM":   syscall.SIGALRM,
+	"HUP":    syscall.SIGHUP,
+	"INT":    syscall.SIGINT,
+	"KILL":   syscall.SIGKILL,
+	"PIPE":   syscall.SIGPIPE,
+	"QUIT":   syscall.SIGQUIT,
+	"TERM":   syscall.SIGTERM,
+	"USR1":   syscall.SIGUSR1,
+	"USR2":   syscall.SIGUSR2,
+	"WINCH":  syscall.SIGWINCH,
+	"TTIN":   syscall.SIGTTIN,
+	"TTOU":   syscall.SIGTTOU,
+	"CONT":   syscall.SIGCONT,
+	"TSTP":   syscall.SIGTSTP,
+	"URG":    syscall.SIGURG,
+	"IO":     syscall.SIGIO,
+	"PROF":   syscall.SIGPROF,
+	"VTALRM": syscall.SIGVTALRM,
+	"XCPU":   syscall.SIGXCPU,
+	"XFSZ":   syscall.SIGXFSZ,
+}
+
+// ParseSignal accepts a signal name, with or without its SIG prefix, or its
+// number: SIGTERM, TERM and 15 are the same signal.
+func ParseSignal(value string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(value); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(value), "SIG")
+
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+
+	return 0, fmt.Errorf("Unknown signal %s", value)
+}
+
+// ParseSignals parses a comma-separated list of signals.
+func ParseSignals(value string) ([]syscall.Signal, error) {
+	var result []syscall.Signal
+
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		sig, err := ParseSignal(name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, sig)
+	}
+
+	return result, nil
+}
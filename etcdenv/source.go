@@ -0,0 +1,61 @@
+package etcdenv
+
+import "fmt"
+
+const (
+	EtcdAPIv2 = "v2"
+	EtcdAPIv3 = "v3"
+)
+
+// Change describes the new value of a key, a deleted key has an empty value.
+// Index is the etcd index at which the change happened.
+type Change struct {
+	Key   string
+	Value string
+	Index uint64
+}
+
+// Source provides the variables stored under the namespaces and streams
+// their changes. Keys are always absolute, the context strips the
+// namespaces by itself.
+type Source interface {
+	// Snapshot returns the variables currently stored in the namespace and
+	// the etcd index they have been read at.
+	Snapshot(namespace string) (map[string]string, uint64, error)
+
+	// Watch sends every change of the namespace happening after the given
+	// index to the changes channel and blocks until an error occurs or the
+	// stop channel is triggered, in which case it returns an
+	// ErrWatchStopped error. The last index seen is returned so the watch
+	// can be resumed without losing any change, an ErrIndexCleared error
+	// means the changes since the index are not available anymore.
+	Watch(namespace string, index uint64, changes chan<- *Change, stop chan bool) (uint64, error)
+
+	Close() error
+}
+
+// NewEtcdSource builds the source matching the etcd API version, the TLS
+// configuration is optional.
+func NewEtcdSource(apiVersion string, endpoints []string, username, password string,
+	tlsConfig *TLSConfig) (Source, error) {
+	switch apiVersion {
+	case EtcdAPIv2, "":
+		source, err := NewEtcdV2Source(endpoints, username, password, tlsConfig)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return source, nil
+	case EtcdAPIv3:
+		source, err := NewEtcdV3Source(endpoints, username, password, tlsConfig)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return source, nil
+	}
+
+	return nil, fmt.Errorf("Choose a correct etcd API version : %s | %s", EtcdAPIv2, EtcdAPIv3)
+}
@@ -0,0 +1,37 @@
+package etcdenv
+
+import (
+	"fmt"
+	"time"
+)
+
+// StartupPolicy tells what to do when some namespaces can't be read before
+// starting the command.
+type StartupPolicy string
+
+const (
+	// StartupStrict refuses to start the command.
+	StartupStrict StartupPolicy = "strict"
+	// StartupDegraded starts the command with the variables read so far,
+	// or with the cached ones when etcd is unreachable.
+	StartupDegraded StartupPolicy = "degraded"
+	// StartupWait waits for every namespace to be readable, up to the
+	// startup timeout.
+	StartupWait StartupPolicy = "wait"
+
+	DefaultStartupTimeout = time.Minute
+)
+
+func ParseStartupPolicy(value string) (StartupPolicy, error) {
+	switch StartupPolicy(value) {
+	case StartupStrict, StartupDegraded, StartupWait:
+		return StartupPolicy(value), nil
+	}
+
+	return "", fmt.Errorf(
+		"Choose a correct startup policy : %s | %s | %s",
+		StartupStrict,
+		StartupDegraded,
+		StartupWait,
+	)
+}
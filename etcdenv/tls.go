@@ -0,0 +1,92 @@
+package etcdenv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// TLSConfig holds the certificates used to reach etcd over TLS, CertFile
+// and KeyFile being the client certificate used for mutual TLS.
+type TLSConfig struct {
+	CertFile           string
+	KeyFile            string
+	CACertFile         string
+	InsecureSkipVerify bool
+}
+
+func (c *TLSConfig) build() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("Both the client certificate and its key are required")
+		}
+
+		certPEM, err := ioutil.ReadFile(c.CertFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("Can't read the client certificate: %s", err.Error())
+		}
+
+		keyPEM, err := ioutil.ReadFile(c.KeyFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("Can't read the client key: %s", err.Error())
+		}
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Invalid client certificate %s and key %s: %s",
+				c.CertFile,
+				c.KeyFile,
+				err.Error(),
+			)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.CACertFile != "" {
+		caPEM, err := ioutil.ReadFile(c.CACertFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("Can't read the CA certificate: %s", err.Error())
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("No valid certificate found in %s", c.CACertFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// buildTLSConfig returns a nil configuration when TLS is not configured.
+func buildTLSConfig(tlsConfig *TLSConfig) (*tls.Config, error) {
+	if tlsConfig == nil {
+		return nil, nil
+	}
+
+	return tlsConfig.build()
+}
+
+func newHTTPTransport(config *tls.Config) *http.Transport {
+	return &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout:   time.Second,
+			KeepAlive: time.Second,
+		}).Dial,
+		TLSClientConfig: config,
+	}
+}
@@ -0,0 +1,54 @@
+package etcdenv
+
+import (
+	"fmt"
+	"strings"
+)
+
+type KeyCase string
+
+const (
+	KeyCasePreserve KeyCase = "preserve"
+	KeyCaseUpper    KeyCase = "upper"
+	KeyCaseLower    KeyCase = "lower"
+
+	DefaultKeySeparator = "_"
+)
+
+func ParseKeyCase(value string) (KeyCase, error) {
+	switch KeyCase(value) {
+	case KeyCasePreserve, KeyCaseUpper, KeyCaseLower:
+		return KeyCase(value), nil
+	}
+
+	return "", fmt.Errorf(
+		"Choose a correct key case : %s | %s | %s",
+		KeyCasePreserve,
+		KeyCaseUpper,
+		KeyCaseLower,
+	)
+}
+
+func (c KeyCase) apply(name string) string {
+	switch c {
+	case KeyCaseUpper:
+		return strings.ToUpper(name)
+	case KeyCaseLower:
+		return strings.ToLower(name)
+	}
+
+	return name
+}
+
+func namespacePrefix(namespace string) string {
+	return strings.TrimSuffix(namespace, "/") + "/"
+}
+
+// flattenKey turns a key relative to its namespace into a variable name,
+// every nested directory being joined with the separator:
+// database/HOST becomes database_HOST.
+func flattenKey(key, separator string, keyCase KeyCase) string {
+	parts := strings.Split(strings.Trim(key, "/"), "/")
+
+	return keyCase.apply(strings.Join(parts, separator))
+}